@@ -10,5 +10,7 @@ func main() {
 	appConfig := config.LoadConfig()
 
 	server := web.NewServer(appConfig)
-	log.Fatal().Err(server.Run()).Msg("Server failed to run")
+	if err := server.Run(); err != nil {
+		log.Fatal().Err(err).Msg("Server failed to run")
+	}
 }
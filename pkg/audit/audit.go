@@ -0,0 +1,257 @@
+package audit
+
+import (
+	"bytes"
+	"consented/pkg/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditEventTypeSystem    = "http://terminology.hl7.org/CodeSystem/audit-event-type"
+	RestfulInteraction      = "http://hl7.org/fhir/restful-interaction"
+	AuditEntityTypeSystem   = "http://terminology.hl7.org/CodeSystem/audit-entity-type"
+	ObjectRoleSystem        = "http://terminology.hl7.org/CodeSystem/object-role"
+	PseudonymIdentifierType = "http://terminology.hl7.org/CodeSystem/v3-ObservationValue"
+	// queueSize is the maximum number of AuditEvents waiting to be sent to the
+	// FHIR server
+	queueSize = 1000
+)
+
+// Result is the consent status of a single domain
+type Result struct {
+	Domain string
+	Status string
+}
+
+// RESTful interactions of audit events
+const (
+	Search = "search"
+	Create = "create"
+)
+
+// Event is a consent status lookup or a recorded consent of a client
+type Event struct {
+	// Interaction defaults to Search
+	Interaction string
+	Client      string
+	PatientId   string
+	SourceIp    string
+	Time        time.Time
+	Results     []Result
+}
+
+// Logger records consent status lookups as FHIR AuditEvent resources to a
+// local NDJSON file and optionally to a FHIR server. A nil Logger discards
+// all events.
+type Logger struct {
+	site         string
+	file         io.WriteCloser
+	fhir         config.Fhir
+	pseudonymKey []byte
+	client       *http.Client
+	// queue of AuditEvents sent to the FHIR server by a single worker
+	mu      sync.Mutex
+	queue   chan []byte
+	closed  bool
+	pending sync.WaitGroup
+}
+
+// NewLogger creates the audit logger from config. It returns nil if auditing
+// is disabled.
+func NewLogger(c config.Audit, site string) (*Logger, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	l := &Logger{site: site, fhir: c.Fhir}
+
+	if c.Pseudonymize.Enabled {
+		if c.Pseudonymize.Key == "" {
+			return nil, errors.New("'audit.pseudonymize.key' is required for pseudonymization")
+		}
+		l.pseudonymKey = []byte(c.Pseudonymize.Key)
+	}
+
+	if c.File.Path != "" {
+		f, err := newRotatingFile(c.File.Path, c.File.MaxSize, c.File.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.file = f
+	}
+
+	if c.Fhir.Base != "" {
+		l.client = &http.Client{Timeout: 10 * time.Second}
+		l.queue = make(chan []byte, queueSize)
+		l.pending.Add(1)
+		go func() {
+			defer l.pending.Done()
+			for data := range l.queue {
+				l.send(data)
+			}
+		}()
+	}
+
+	return l, nil
+}
+
+// Log records the event
+func (l *Logger) Log(e Event) {
+	if l == nil {
+		return
+	}
+
+	data, err := l.toAuditEvent(e).MarshalJSON()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to serialize AuditEvent")
+		return
+	}
+
+	if l.file != nil {
+		if _, err = l.file.Write(append(data, '\n')); err != nil {
+			log.Error().Err(err).Msg("Failed to write AuditEvent to audit file")
+		}
+	}
+
+	if l.queue != nil {
+		l.enqueue(data)
+	}
+}
+
+func (l *Logger) enqueue(data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		log.Error().Msg("Failed to send AuditEvent. Audit logger is closed")
+		return
+	}
+	select {
+	case l.queue <- data:
+	default:
+		log.Error().Int("queue-size", queueSize).Msg("Failed to send AuditEvent. Queue is full")
+	}
+}
+
+// Close sends the queued AuditEvents and closes the audit file
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.queue != nil && !l.closed {
+		close(l.queue)
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	l.pending.Wait()
+	if l.file != nil {
+		return l.file.Close()
+	}
+	return nil
+}
+
+func (l *Logger) send(data []byte) {
+	url := strings.TrimSuffix(l.fhir.Base, "/") + "/AuditEvent"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create AuditEvent request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	if l.fhir.Auth != nil {
+		req.SetBasicAuth(l.fhir.Auth.User, l.fhir.Auth.Password)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		log.Error().Err(err).Str("url", url).Msg("Failed to send AuditEvent")
+		return
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Error().Int("statusCode", resp.StatusCode).Str("url", url).Msg("Failed to send AuditEvent")
+	}
+}
+
+func (l *Logger) toAuditEvent(e Event) fhir.AuditEvent {
+	patient := &fhir.Identifier{Value: of(e.PatientId)}
+	if l.pseudonymKey != nil {
+		patient = &fhir.Identifier{
+			Type: &fhir.CodeableConcept{Coding: []fhir.Coding{{
+				System: of(PseudonymIdentifierType),
+				Code:   of("PSEUDED"),
+			}}},
+			Value: of(l.pseudonymize(e.PatientId)),
+		}
+	}
+
+	entities := []fhir.AuditEventEntity{{
+		What: &fhir.Reference{Identifier: patient},
+		Type: &fhir.Coding{System: of(AuditEntityTypeSystem), Code: of("1"), Display: of("Person")},
+		Role: &fhir.Coding{System: of(ObjectRoleSystem), Code: of("1"), Display: of("Patient")},
+	}}
+	for _, r := range e.Results {
+		entities = append(entities, fhir.AuditEventEntity{
+			Type:        &fhir.Coding{System: of(AuditEntityTypeSystem), Code: of("2"), Display: of("System Object")},
+			Role:        &fhir.Coding{System: of(ObjectRoleSystem), Code: of("4"), Display: of("Domain Resource")},
+			Name:        of(r.Domain),
+			Description: of(r.Status),
+		})
+	}
+
+	agent := fhir.AuditEventAgent{
+		Who:       &fhir.Reference{Display: of(e.Client)},
+		Name:      of(e.Client),
+		Requestor: true,
+	}
+	if e.SourceIp != "" {
+		agent.Network = &fhir.AuditEventAgentNetwork{
+			Address: of(e.SourceIp),
+			Type:    of(fhir.AuditEventAgentNetworkType2),
+		}
+	}
+
+	interaction, action := Search, fhir.AuditEventActionE
+	if e.Interaction == Create {
+		interaction, action = Create, fhir.AuditEventActionC
+	}
+
+	return fhir.AuditEvent{
+		Type:     fhir.Coding{System: of(AuditEventTypeSystem), Code: of("rest"), Display: of("RESTful Operation")},
+		Subtype:  []fhir.Coding{{System: of(RestfulInteraction), Code: of(interaction), Display: of(interaction)}},
+		Action:   of(action),
+		Recorded: e.Time.Format(time.RFC3339Nano),
+		Outcome:  of(fhir.AuditEventOutcome0),
+		Agent:    []fhir.AuditEventAgent{agent},
+		Source: fhir.AuditEventSource{
+			Site:     of(l.site),
+			Observer: fhir.Reference{Display: of(l.site)},
+		},
+		Entity: entities,
+	}
+}
+
+// pseudonymize replaces the patient id by its HMAC-SHA256 (hex encoded)
+func (l *Logger) pseudonymize(id string) string {
+	mac := hmac.New(sha256.New, l.pseudonymKey)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func of[E any](e E) *E {
+	return &e
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"bufio"
+	"consented/pkg/config"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestNewLoggerDisabled(t *testing.T) {
+	l, err := NewLogger(config.Audit{}, "consented")
+
+	assert.NoError(t, err)
+	assert.Nil(t, l)
+
+	// nil logger discards events
+	l.Log(Event{})
+	assert.NoError(t, l.Close())
+}
+
+func TestNewLoggerMissingPseudonymKey(t *testing.T) {
+	_, err := NewLogger(config.Audit{Enabled: true, Pseudonymize: config.Pseudonymize{Enabled: true}}, "consented")
+
+	assert.Error(t, err)
+}
+
+func TestLogToFile(t *testing.T) {
+	file := path.Join(t.TempDir(), "audit.ndjson")
+	l, _ := NewLogger(config.Audit{Enabled: true, File: config.AuditFile{Path: file}}, "consented")
+
+	recorded := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	l.Log(testEvent(recorded))
+	l.Log(testEvent(recorded))
+	_ = l.Close()
+
+	events := readEvents(t, file)
+	assert.Len(t, events, 2)
+
+	e := events[0]
+	assert.Equal(t, "2024-01-02T03:04:05Z", e.Recorded)
+	assert.Equal(t, "registry", *e.Agent[0].Name)
+	assert.Equal(t, "10.0.0.1", *e.Agent[0].Network.Address)
+	assert.Equal(t, "42", *e.Entity[0].What.Identifier.Value)
+	assert.Equal(t, "MII", *e.Entity[1].Name)
+	assert.Equal(t, "accepted", *e.Entity[1].Description)
+}
+
+func TestLogPseudonymized(t *testing.T) {
+	file := path.Join(t.TempDir(), "audit.ndjson")
+	l, _ := NewLogger(config.Audit{
+		Enabled:      true,
+		File:         config.AuditFile{Path: file},
+		Pseudonymize: config.Pseudonymize{Enabled: true, Key: "secret"},
+	}, "consented")
+
+	l.Log(testEvent(time.Now()))
+	_ = l.Close()
+
+	pid := *readEvents(t, file)[0].Entity[0].What.Identifier.Value
+	assert.NotEqual(t, "42", pid)
+	assert.Equal(t, l.pseudonymize("42"), pid)
+	assert.Len(t, pid, 64)
+}
+
+func TestLogToFhirServer(t *testing.T) {
+	received := make(chan []byte, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/fhir/AuditEvent", req.URL.Path)
+		assert.Equal(t, "application/fhir+json", req.Header.Get("Content-Type"))
+
+		b, _ := io.ReadAll(req.Body)
+		received <- b
+		res.WriteHeader(http.StatusCreated)
+	}))
+	defer s.Close()
+
+	l, _ := NewLogger(config.Audit{Enabled: true, Fhir: config.Fhir{Base: s.URL + "/fhir/"}}, "consented")
+
+	l.Log(testEvent(time.Now()))
+	_ = l.Close()
+
+	e, err := fhir.UnmarshalAuditEvent(<-received)
+	assert.NoError(t, err)
+	assert.Equal(t, "consented", *e.Source.Site)
+}
+
+func TestLogInteraction(t *testing.T) {
+	file := path.Join(t.TempDir(), "audit.ndjson")
+	l, _ := NewLogger(config.Audit{Enabled: true, File: config.AuditFile{Path: file}}, "consented")
+
+	e := testEvent(time.Now())
+	l.Log(e)
+	e.Interaction = Create
+	l.Log(e)
+	_ = l.Close()
+
+	events := readEvents(t, file)
+	assert.Equal(t, "search", *events[0].Subtype[0].Code)
+	assert.Equal(t, fhir.AuditEventActionE, *events[0].Action)
+	assert.Equal(t, "create", *events[1].Subtype[0].Code)
+	assert.Equal(t, fhir.AuditEventActionC, *events[1].Action)
+}
+
+func TestLogAfterClose(t *testing.T) {
+	l, _ := NewLogger(config.Audit{Enabled: true, Fhir: config.Fhir{Base: "http://localhost:1/fhir"}}, "consented")
+	assert.NoError(t, l.Close())
+
+	// discarded
+	l.Log(testEvent(time.Now()))
+	assert.NoError(t, l.Close())
+}
+
+func testEvent(recorded time.Time) Event {
+	return Event{
+		Client:    "registry",
+		PatientId: "42",
+		SourceIp:  "10.0.0.1",
+		Time:      recorded,
+		Results:   []Result{{Domain: "MII", Status: "accepted"}},
+	}
+}
+
+func readEvents(t *testing.T, file string) []fhir.AuditEvent {
+	f, err := os.Open(file)
+	assert.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	var events []fhir.AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e, err := fhir.UnmarshalAuditEvent(scanner.Bytes())
+		assert.NoError(t, err)
+		events = append(events, e)
+	}
+
+	return events
+}
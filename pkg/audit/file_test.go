@@ -0,0 +1,42 @@
+package audit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	file := path.Join(t.TempDir(), "audit.ndjson")
+	f, _ := newRotatingFile(file, 1, 2)
+
+	line := make([]byte, megabyte/2)
+	for i := 0; i < 6; i++ {
+		_, err := f.Write(line)
+		assert.NoError(t, err)
+	}
+	// third rotation drops the oldest backup
+	_, _ = f.Write(line)
+	_ = f.Close()
+
+	assert.FileExists(t, file)
+	assert.FileExists(t, file+".1")
+	assert.FileExists(t, file+".2")
+	assert.NoFileExists(t, file+".3")
+
+	info, _ := os.Stat(file)
+	assert.Equal(t, int64(megabyte/2), info.Size())
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	file := path.Join(t.TempDir(), "audit.ndjson")
+	_ = os.WriteFile(file, []byte("existing\n"), 0640)
+
+	f, _ := newRotatingFile(file, 1, 1)
+	_, _ = f.Write([]byte("new\n"))
+	_ = f.Close()
+
+	data, _ := os.ReadFile(file)
+	assert.Equal(t, "existing\nnew\n", string(data))
+}
@@ -9,18 +9,68 @@ import (
 )
 
 type AppConfig struct {
-	App  App  `mapstructure:"app"`
-	Gics Gics `mapstructure:"gics"`
+	App      App      `mapstructure:"app"`
+	Gics     Gics     `mapstructure:"gics"`
+	Audit    Audit    `mapstructure:"audit"`
+	Identity Identity `mapstructure:"identity"`
+	Webhooks Webhooks `mapstructure:"webhooks"`
 }
 
 type Http struct {
-	Auth Auth   `mapstructure:"auth"`
-	Port string `mapstructure:"port"`
+	Auth         Auth      `mapstructure:"auth"`
+	Clients      []Client  `mapstructure:"clients"`
+	ClientsFile  string    `mapstructure:"clients-file"`
+	ApiKeyHeader string    `mapstructure:"api-key-header"`
+	Oidc         Oidc      `mapstructure:"oidc"`
+	RateLimit    RateLimit `mapstructure:"rate-limit"`
+	Port         string    `mapstructure:"port"`
+}
+
+// RateLimit configures a token bucket per API client. A rate of zero
+// disables rate limiting.
+type RateLimit struct {
+	RequestsPerSecond float64 `mapstructure:"requests-per-second"`
+	Burst             int     `mapstructure:"burst"`
+}
+
+// Oidc configures bearer token (JWT) authentication. It is enabled by setting
+// the issuer.
+type Oidc struct {
+	Issuer        string `mapstructure:"issuer"`
+	Audience      string `mapstructure:"audience"`
+	JwksUrl       string `mapstructure:"jwks-url"`
+	JwksFile      string `mapstructure:"jwks-file"`
+	CacheDuration string `mapstructure:"cache-duration"`
+	NameClaim     string `mapstructure:"name-claim"`
+	RolesClaim    string `mapstructure:"roles-claim"`
 }
 
 type App struct {
+	Name     string `mapstructure:"name"`
 	LogLevel string `mapstructure:"log-level"`
-	Http     Http   `mapstructure:"http"`
+	// Timezone consents are evaluated in, e.g. Europe/Berlin
+	Timezone      string        `mapstructure:"timezone"`
+	Http          Http          `mapstructure:"http"`
+	Authorization Authorization `mapstructure:"authorization"`
+}
+
+// Authorization restricts the domains API clients are allowed to query.
+// Without rules, all domains are allowed.
+type Authorization struct {
+	// Denied controls how denied domains are reported: 'omit' or 'forbidden'
+	Denied string `mapstructure:"denied"`
+	Rules  []Rule `mapstructure:"rules"`
+}
+
+// Rule grants access to domains (by name or department) for the listed
+// clients or token roles.
+type Rule struct {
+	Clients     []string `mapstructure:"clients"`
+	Roles       []string `mapstructure:"roles"`
+	Domains     []string `mapstructure:"domains"`
+	Departments []string `mapstructure:"departments"`
+	// Write allows to record consents in the domains
+	Write bool `mapstructure:"write"`
 }
 
 type Auth struct {
@@ -28,9 +78,97 @@ type Auth struct {
 	Password string `mapstructure:"password"`
 }
 
+// Client is an API client which authenticates either via Basic Auth with a
+// bcrypt hashed password or via a static API key.
+type Client struct {
+	Name         string `mapstructure:"name"`
+	User         string `mapstructure:"user"`
+	PasswordHash string `mapstructure:"password-hash"`
+	ApiKey       string `mapstructure:"api-key"`
+}
+
 type Gics struct {
-	UpdateInterval string `mapstructure:"update-interval"`
-	Fhir           Fhir   `mapstructure:"fhir"`
+	UpdateInterval        string        `mapstructure:"update-interval"`
+	MaxConcurrentRequests int           `mapstructure:"max-concurrent-requests"`
+	QueueTimeout          string        `mapstructure:"queue-timeout"`
+	AskConsentBefore      string        `mapstructure:"ask-consent-before"`
+	Fhir                  Fhir          `mapstructure:"fhir"`
+	Notifications         Notifications `mapstructure:"notifications"`
+}
+
+// Notifications configures the inbound endpoint for notifications of the gICS
+// notification service
+type Notifications struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Clients allowed to send notifications
+	Clients []string `mapstructure:"clients"`
+	// Workers handling accepted notifications
+	Workers int `mapstructure:"workers"`
+	// QueueSize is the number of accepted notifications waiting for a worker
+	QueueSize int `mapstructure:"queue-size"`
+}
+
+// Audit configures the audit trail of consent status queries
+type Audit struct {
+	Enabled      bool         `mapstructure:"enabled"`
+	File         AuditFile    `mapstructure:"file"`
+	Fhir         Fhir         `mapstructure:"fhir"`
+	Pseudonymize Pseudonymize `mapstructure:"pseudonymize"`
+}
+
+// Identity configures the resolution of incoming patient ids to gICS signer
+// ids via a TTP service
+type Identity struct {
+	// Resolver is 'gpas' or 'epix' (empty: disabled)
+	Resolver string `mapstructure:"resolver"`
+	Fhir     Fhir   `mapstructure:"fhir"`
+	// Domain of the gPAS pseudonyms or E-PIX persons
+	Domain string `mapstructure:"domain"`
+	// IdentifierDomain of the incoming patient ids (E-PIX)
+	IdentifierDomain string `mapstructure:"identifier-domain"`
+	// SourceSystem of typed patient ids, which are resolved (empty: only bare
+	// patient ids)
+	SourceSystem string `mapstructure:"source-system"`
+	// System of the resolved ids. Only gICS domains with this signer id
+	// system are resolved (empty: all domains).
+	System        string `mapstructure:"system"`
+	CacheDuration string `mapstructure:"cache-duration"`
+	// Timeout of requests to the FHIR gateway
+	Timeout string `mapstructure:"timeout"`
+}
+
+// Webhooks configures notifications of subscribed clients about status
+// changes of watched patients
+type Webhooks struct {
+	Enabled bool `mapstructure:"enabled"`
+	// CheckInterval the watched patients are re-evaluated with
+	CheckInterval string `mapstructure:"check-interval"`
+	// Store is the file subscriptions are persisted to (empty: in memory)
+	Store string `mapstructure:"store"`
+	// SubscriptionTtl is the lifetime of subscriptions. The client's roles are
+	// only checked at registration.
+	SubscriptionTtl string `mapstructure:"subscription-ttl"`
+	Timeout         string `mapstructure:"timeout"`
+	// MaxRetries of failed deliveries, the backoff doubles with each retry
+	MaxRetries   int    `mapstructure:"max-retries"`
+	RetryBackoff string `mapstructure:"retry-backoff"`
+	// AllowedHosts of subscription urls, e.g. 'registry.example.org' or
+	// '*.example.org' (empty: all hosts)
+	AllowedHosts []string `mapstructure:"allowed-hosts"`
+	// RequireHttps rejects subscription urls without TLS
+	RequireHttps bool `mapstructure:"require-https"`
+}
+
+type AuditFile struct {
+	Path string `mapstructure:"path"`
+	// MaxSize in megabytes before the file is rotated
+	MaxSize    int `mapstructure:"max-size"`
+	MaxBackups int `mapstructure:"max-backups"`
+}
+
+type Pseudonymize struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Key     string `mapstructure:"key"`
 }
 
 type Fhir struct {
@@ -73,5 +211,34 @@ func parseConfig(path string) (config *AppConfig, err error) {
 	}
 
 	err = viper.Unmarshal(&config)
-	return config, err
+	if err != nil {
+		return nil, err
+	}
+
+	// additional API clients from file
+	if config.App.Http.ClientsFile != "" {
+		clients, err := loadClients(config.App.Http.ClientsFile)
+		if err != nil {
+			return nil, err
+		}
+		config.App.Http.Clients = append(config.App.Http.Clients, clients...)
+	}
+
+	return config, nil
+}
+
+// loadClients reads a list of API clients from a separate (e.g. mounted)
+// YAML file with a top level 'clients' key.
+func loadClients(file string) ([]Client, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("yml")
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var clients []Client
+	err := v.UnmarshalKey("clients", &clients)
+	return clients, err
 }
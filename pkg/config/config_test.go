@@ -48,3 +48,24 @@ func setProjectDir() {
 
 	viper.Reset()
 }
+
+func TestParseConfigWithClientsFile(t *testing.T) {
+	setProjectDir()
+
+	file := path.Join(t.TempDir(), "clients.yml")
+	_ = os.WriteFile(file, []byte(`clients:
+  - name: registry
+    user: reg
+    password-hash: $2a$04$hash
+  - name: pipeline
+    api-key: key-42
+`), 0600)
+	t.Setenv("APP_HTTP_CLIENTS_FILE", file)
+
+	config := LoadConfig()
+
+	assert.Equal(t, []Client{
+		{Name: "registry", User: "reg", PasswordHash: "$2a$04$hash"},
+		{Name: "pipeline", ApiKey: "key-42"},
+	}, config.App.Http.Clients)
+}
@@ -55,6 +55,7 @@ func StructuredLogger(logger *zerolog.Logger) gin.HandlerFunc {
 		}
 
 		logEvent.Str("client_id", param.ClientIP).
+			Str("client", c.GetString(gin.AuthUserKey)).
 			Str("method", param.Method).
 			Int("status_code", param.StatusCode).
 			Int("body_size", param.BodySize).
@@ -0,0 +1,134 @@
+package consent
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var termSeparator = regexp.MustCompile(`[&,]`)
+
+// CheckPolicy is a boolean expression of policy codes in disjunctive normal
+// form, e.g. 'IDAT_erheben&MDAT_erheben|Broad_Consent' means (IDAT_erheben
+// and MDAT_erheben) or Broad_Consent. A comma separated list of codes is
+// equivalent to '&'.
+type CheckPolicy [][]string
+
+func ParseCheckPolicy(s string) (CheckPolicy, error) {
+	var expr CheckPolicy
+	for _, t := range strings.Split(s, "|") {
+		var term []string
+		for _, c := range termSeparator.Split(t, -1) {
+			code := strings.TrimSpace(c)
+			if code == "" || strings.ContainsAny(code, "() ") {
+				return nil, fmt.Errorf("invalid checkPolicy expression: '%s'", s)
+			}
+			term = append(term, code)
+		}
+		expr = append(expr, term)
+	}
+
+	return expr, nil
+}
+
+// Contains is true, if the code is part of the expression
+func (p CheckPolicy) Contains(code string) bool {
+	for _, t := range p {
+		if slices.Contains(t, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p CheckPolicy) String() string {
+	terms := make([]string, 0, len(p))
+	for _, t := range p {
+		terms = append(terms, strings.Join(t, "&"))
+	}
+	return strings.Join(terms, "|")
+}
+
+// policyState is the state of a single policy used for status evaluation
+type policyState struct {
+	permit    bool
+	withdrawn bool
+	signed    time.Time
+	expires   time.Time
+}
+
+// evaluation is the combined state of a check policy (term)
+type evaluation struct {
+	status  Status
+	signed  time.Time
+	expires time.Time
+}
+
+// precedence of evaluation results when combining terms
+var precedence = []Status{NotAsked, Declined, Withdrawn, PartiallyAccepted, Expired, Accepted}
+
+// evaluate derives the status from the states of the policies. The best
+// result of all terms is used, i.e. accepted terms take precedence over
+// expired and partially accepted ones.
+func (p CheckPolicy) evaluate(states map[string]policyState, now time.Time) evaluation {
+	result := evaluation{status: NotAsked}
+	for _, t := range p {
+		e := evaluateTerm(t, states, now)
+
+		rank, best := slices.Index(precedence, e.status), slices.Index(precedence, result.status)
+		if rank > best || (rank == best && e.status == Accepted && e.expires.After(result.expires)) {
+			result = e
+		}
+	}
+
+	return result
+}
+
+func evaluateTerm(codes []string, states map[string]policyState, now time.Time) evaluation {
+	var found, permitted, expired, withdrawn int
+	var signed, expires, permitExpires time.Time
+
+	for _, c := range codes {
+		s, ok := states[c]
+		if !ok {
+			continue
+		}
+		found++
+
+		if s.signed.After(signed) {
+			signed = s.signed
+		}
+		if expires.IsZero() || s.expires.Before(expires) {
+			expires = s.expires
+		}
+
+		if s.permit {
+			permitted++
+			if permitExpires.IsZero() || s.expires.Before(permitExpires) {
+				permitExpires = s.expires
+			}
+			if !s.expires.After(now) {
+				expired++
+			}
+		} else if s.withdrawn {
+			withdrawn++
+		}
+	}
+
+	switch {
+	case found == 0:
+		return evaluation{status: NotAsked}
+	case permitted == len(codes) && expired == 0:
+		return evaluation{Accepted, signed, permitExpires}
+	case permitted == len(codes):
+		return evaluation{Expired, signed, permitExpires}
+	case permitted > expired:
+		return evaluation{PartiallyAccepted, signed, expires}
+	case withdrawn > 0:
+		return evaluation{Withdrawn, signed, expires}
+	default:
+		return evaluation{Declined, signed, expires}
+	}
+}
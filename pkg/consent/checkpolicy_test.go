@@ -0,0 +1,128 @@
+package consent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseCheckPolicy(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected CheckPolicy
+	}{
+		{"MDAT_erheben", CheckPolicy{{"MDAT_erheben"}}},
+		{"IDAT_erheben&MDAT_erheben", CheckPolicy{{"IDAT_erheben", "MDAT_erheben"}}},
+		{"IDAT_erheben, MDAT_erheben", CheckPolicy{{"IDAT_erheben", "MDAT_erheben"}}},
+		{"A|B", CheckPolicy{{"A"}, {"B"}}},
+		{"A & B | C", CheckPolicy{{"A", "B"}, {"C"}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			actual, err := ParseCheckPolicy(c.value)
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, actual)
+		})
+	}
+}
+
+func TestParseCheckPolicyInvalid(t *testing.T) {
+	for _, v := range []string{"", "A|", "|A", "A&&", "(A|B)&C", "A B"} {
+		t.Run(v, func(t *testing.T) {
+			_, err := ParseCheckPolicy(v)
+
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCheckPolicyString(t *testing.T) {
+	expr, _ := ParseCheckPolicy("A & B | C")
+
+	assert.Equal(t, "A&B|C", expr.String())
+}
+
+func TestEvaluateCheckPolicy(t *testing.T) {
+	now := time.Now()
+	signed := now.AddDate(-1, 0, 0)
+	soon := now.AddDate(1, 0, 0)
+	later := now.AddDate(5, 0, 0)
+
+	permit := policyState{permit: true, signed: signed, expires: later}
+	permitSoon := policyState{permit: true, signed: signed, expires: soon}
+	expired := policyState{permit: true, signed: signed, expires: now.AddDate(0, 0, -1)}
+	deny := policyState{permit: false, signed: signed, expires: later}
+	withdrawn := policyState{permit: false, withdrawn: true, signed: signed, expires: later}
+
+	cases := []struct {
+		name     string
+		expr     string
+		states   map[string]policyState
+		expected evaluation
+	}{
+		{
+			name:     "andAccepted",
+			expr:     "A&B",
+			states:   map[string]policyState{"A": permit, "B": permitSoon},
+			expected: evaluation{Accepted, signed, soon},
+		},
+		{
+			name:     "andPartiallyAccepted",
+			expr:     "A&B",
+			states:   map[string]policyState{"A": permit, "B": deny},
+			expected: evaluation{PartiallyAccepted, signed, later},
+		},
+		{
+			name:     "andMissingPolicy",
+			expr:     "A&B",
+			states:   map[string]policyState{"A": permit},
+			expected: evaluation{PartiallyAccepted, signed, later},
+		},
+		{
+			name:     "andExpired",
+			expr:     "A&B",
+			states:   map[string]policyState{"A": permit, "B": expired},
+			expected: evaluation{Expired, signed, expired.expires},
+		},
+		{
+			name:     "andDeclined",
+			expr:     "A&B",
+			states:   map[string]policyState{"A": deny, "B": deny},
+			expected: evaluation{Declined, signed, later},
+		},
+		{
+			name:     "orAccepted",
+			expr:     "A|B",
+			states:   map[string]policyState{"A": deny, "B": permit},
+			expected: evaluation{Accepted, signed, later},
+		},
+		{
+			name:     "orLatestExpiry",
+			expr:     "A|B",
+			states:   map[string]policyState{"A": permitSoon, "B": permit},
+			expected: evaluation{Accepted, signed, later},
+		},
+		{
+			name:     "orWithdrawn",
+			expr:     "A|B",
+			states:   map[string]policyState{"A": withdrawn, "B": deny},
+			expected: evaluation{Withdrawn, signed, later},
+		},
+		{
+			name:     "notFound",
+			expr:     "A|B",
+			states:   map[string]policyState{},
+			expected: evaluation{status: NotAsked},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expr, _ := ParseCheckPolicy(c.expr)
+
+			assert.Equal(t, c.expected, expr.evaluate(c.states, now))
+		})
+	}
+}
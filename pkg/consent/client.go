@@ -3,6 +3,7 @@ package consent
 import (
 	"bytes"
 	"consented/pkg/config"
+	"consented/pkg/identity"
 	"errors"
 	"github.com/rs/zerolog/log"
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
@@ -10,13 +11,18 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"time"
 )
 
 type GicsClient interface {
 	GetDomains() ([]fhir.ResearchStudy, error)
-	GetConsentPolicies(signerId string, domain Domain) (*fhir.Bundle, error)
+	GetConsentPolicies(signerId identity.Identifier, domain Domain) (*fhir.Bundle, error)
+	GetConsentPoliciesAt(signerId identity.Identifier, domain Domain, at time.Time) (*fhir.Bundle, error)
+	GetConsents(signerId identity.Identifier, domain Domain) (*fhir.Bundle, error)
 	GetTemplate(domain string, templateType string) string
+	GetQuestionnaires(domain string) ([]fhir.Questionnaire, error)
 	GetSourceReferenceTemplate(id string) string
+	AddConsent(domain Domain, document *fhir.Bundle) error
 }
 
 type GicsHttpClient struct {
@@ -86,7 +92,34 @@ func parseResponse(response *http.Response, err error) ([]byte, error) {
 	return responseData, nil
 }
 
-func (c *GicsHttpClient) GetConsentPolicies(signerId string, domain Domain) (*fhir.Bundle, error) {
+func (c *GicsHttpClient) GetConsentPolicies(signerId identity.Identifier, domain Domain) (*fhir.Bundle, error) {
+	return c.postPersonOperation("$currentPolicyStatesForPerson", signerId, domain)
+}
+
+// GetConsentPoliciesAt returns the policy states of the person, which were
+// valid at the given time. They are derived from all consents of the person,
+// applying the domain's quality control.
+func (c *GicsHttpClient) GetConsentPoliciesAt(signerId identity.Identifier, domain Domain, at time.Time) (*fhir.Bundle, error) {
+	b, err := c.GetConsents(signerId, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return policyStatesAt(b, at, domain.AcceptedQcStates), nil
+}
+
+// GetConsents returns all consents of the person in the domain
+func (c *GicsHttpClient) GetConsents(signerId identity.Identifier, domain Domain) (*fhir.Bundle, error) {
+	return c.postPersonOperation("$allConsentsForPerson", signerId, domain)
+}
+
+// postPersonOperation posts the operation for the signer. Without system, the
+// signer id is of the domain's primary signer id system.
+func (c *GicsHttpClient) postPersonOperation(operation string, signerId identity.Identifier, domain Domain) (*fhir.Bundle, error) {
+	system := signerId.System
+	if system == "" {
+		system = domain.PersonIdSystem
+	}
 
 	fhirRequest := fhir.Parameters{
 		Id:   nil,
@@ -94,7 +127,7 @@ func (c *GicsHttpClient) GetConsentPolicies(signerId string, domain Domain) (*fh
 		Parameter: []fhir.ParametersParameter{
 			{
 				Name:            "personIdentifier",
-				ValueIdentifier: &fhir.Identifier{System: &domain.PersonIdSystem, Value: &signerId},
+				ValueIdentifier: &fhir.Identifier{System: &system, Value: &signerId.Value},
 			},
 			{
 				Name:        "domain",
@@ -108,16 +141,16 @@ func (c *GicsHttpClient) GetConsentPolicies(signerId string, domain Domain) (*fh
 	}
 
 	// post request to gICS
-	data, err := parseResponse(c.postRequest(c.BaseUrl+"/$currentPolicyStatesForPerson", r))
+	data, err := parseResponse(c.postRequest(c.BaseUrl+"/"+operation, r))
 
 	if err != nil {
-		log.Error().Err(err).Msg("POST request to gICS failed for: " + c.BaseUrl + "/$currentPolicyStatesForPerson")
+		log.Error().Err(err).Msg("POST request to gICS failed for: " + c.BaseUrl + "/" + operation)
 		return nil, err
 	}
 
 	res, err := fhir.UnmarshalBundle(data)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to deserialize FHIR response from  gICS. Expected 'Parameters' resource")
+		log.Fatal().Err(err).Msg("Failed to deserialize FHIR response from  gICS. Expected 'Bundle' resource")
 		return nil, err
 	}
 
@@ -126,6 +159,28 @@ func (c *GicsHttpClient) GetConsentPolicies(signerId string, domain Domain) (*fh
 
 func (c *GicsHttpClient) GetTemplate(domain string, targetType string) string {
 
+	qs, err := c.GetQuestionnaires(domain)
+	if err != nil {
+		return ""
+	}
+
+	for _, r := range qs {
+		if len(r.Code) == 0 || r.Url == nil {
+			continue
+		}
+		coding := r.Code[0]
+		if coding.System != nil && *coding.System == TemplateType && coding.Code != nil && *coding.Code == targetType {
+			log.Debug().Str("type", targetType).Msg("Found gICS template")
+			return path.Base(*r.Url)
+		}
+	}
+
+	return ""
+}
+
+// GetQuestionnaires returns the consent templates of the domain
+func (c *GicsHttpClient) GetQuestionnaires(domain string) ([]fhir.Questionnaire, error) {
+
 	base, _ := url.Parse(c.BaseUrl + "Questionnaire")
 	params := url.Values{}
 	params.Add("useContextIdentifier", domain)
@@ -135,32 +190,27 @@ func (c *GicsHttpClient) GetTemplate(domain string, targetType string) string {
 	data, err := parseResponse(c.newRequest(http.MethodGet, base.String(), nil))
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to parse response")
-		return ""
-
+		return nil, err
 	}
 
 	// unmarshal
 	bundle, err := fhir.UnmarshalBundle(data)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to unmarshal response data")
-		return ""
+		return nil, err
 	}
 
+	qs := make([]fhir.Questionnaire, 0, len(bundle.Entry))
 	for _, t := range bundle.Entry {
-		if r, err := fhir.UnmarshalQuestionnaire(t.Resource); err == nil {
-			coding := r.Code[0]
-			if *coding.System == TemplateType && *coding.Code == targetType {
-				log.Debug().Str("type", targetType).Msg("Found gICS template")
-				return path.Base(*r.Url)
-			}
-
-		} else {
+		r, err := fhir.UnmarshalQuestionnaire(t.Resource)
+		if err != nil {
 			log.Error().Err(err).Msg("Failed to parse Questionnaire response")
-			return ""
+			return nil, err
 		}
+		qs = append(qs, r)
 	}
 
-	return ""
+	return qs, nil
 }
 
 func (c *GicsHttpClient) GetSourceReferenceTemplate(ref string) string {
@@ -180,6 +230,31 @@ func (c *GicsHttpClient) GetSourceReferenceTemplate(ref string) string {
 	return ""
 }
 
+// AddConsent submits the consent document to gICS
+func (c *GicsHttpClient) AddConsent(domain Domain, document *fhir.Bundle) error {
+	r, err := document.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	response, err := c.postRequest(c.BaseUrl+"/$addConsent", r)
+	if err != nil {
+		log.Error().Err(err).Str("domain", domain.Name).Msg("POST request to gICS failed for: " + c.BaseUrl + "/$addConsent")
+		return err
+	}
+	defer closeBody(response.Body)
+
+	// gICS responds with 200 or 201
+	if response.StatusCode >= 300 {
+		data, _ := io.ReadAll(response.Body)
+		err = errors.New(string(data))
+		log.Error().Err(err).Int("statusCode", response.StatusCode).Str("domain", domain.Name).Msg("Failed to add consent to gICS")
+		return err
+	}
+
+	return nil
+}
+
 func (c *GicsHttpClient) postRequest(requestUrl string, body []byte) (*http.Response, error) {
 	return c.newRequest(http.MethodPost, requestUrl, bytes.NewBuffer(body))
 }
@@ -2,11 +2,14 @@ package consent
 
 import (
 	"consented/pkg/config"
+	"consented/pkg/identity"
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestGetDomains(t *testing.T) {
@@ -47,7 +50,7 @@ func TestGetConsentPolicies(t *testing.T) {
 	}})
 
 	// act
-	actual, _ := c.GetConsentPolicies("bla", Domain{
+	actual, _ := c.GetConsentPolicies(identity.Identifier{Value: "bla"}, Domain{
 		Name:            "Foo",
 		Description:     "Bar",
 		CheckPolicyCode: "123",
@@ -57,6 +60,31 @@ func TestGetConsentPolicies(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
+func TestGetConsentPoliciesAt(t *testing.T) {
+
+	b := &fhir.Bundle{Entry: []fhir.BundleEntry{
+		{Resource: historyConsent("2020-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit))},
+		{Resource: historyConsent("2022-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypeDeny))},
+	}}
+	resp, _ := b.MarshalJSON()
+	s := withTestServer(resp, 200)
+	defer s.Close()
+
+	c := NewGicsClient(config.AppConfig{Gics: config.Gics{
+		UpdateInterval: "1h", Fhir: config.Fhir{Base: s.URL},
+	}})
+
+	// act
+	actual, err := c.GetConsentPoliciesAt(identity.Identifier{Value: "bla"}, Domain{Name: "Foo", PersonIdSystem: "test"},
+		time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	assert.NoError(t, err)
+	if assert.Len(t, actual.Entry, 1) {
+		r, _ := fhir.UnmarshalConsent(actual.Entry[0].Resource)
+		assert.Equal(t, "2020-01-01T10:00:00Z", *r.DateTime)
+	}
+}
+
 func TestGetSourceReferenceTemplate(t *testing.T) {
 	templateUri := "Widerruf+%28kompatibel+zu+Patienteneinwilligung+MII+1.6d%29|2.0.a"
 
@@ -140,6 +168,37 @@ func TestGetTemplate_WithErrors(t *testing.T) {
 	}
 }
 
+func TestPersonIdentifierSystem(t *testing.T) {
+	cases := []struct {
+		name     string
+		signerId identity.Identifier
+		expected string
+	}{
+		{"primary", identity.Identifier{Value: "42"}, "primary"},
+		{"typed", identity.Identifier{System: "secondary", Value: "42"}, "secondary"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var received fhir.Parameters
+			s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				b, _ := io.ReadAll(req.Body)
+				received, _ = fhir.UnmarshalParameters(b)
+				_, _ = res.Write([]byte(`{"resourceType":"Bundle","type":"searchset"}`))
+			}))
+			defer s.Close()
+
+			client := &GicsHttpClient{BaseUrl: s.URL}
+			_, err := client.GetConsentPolicies(c.signerId, Domain{Name: "Foo", PersonIdSystem: "primary"})
+
+			assert.NoError(t, err)
+			id := received.Parameter[0].ValueIdentifier
+			assert.Equal(t, c.expected, *id.System)
+			assert.Equal(t, "42", *id.Value)
+		})
+	}
+}
+
 func withTestServer(response []byte, code int) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 
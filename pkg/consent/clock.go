@@ -0,0 +1,28 @@
+package consent
+
+import "time"
+
+// Clock provides the time consents are evaluated at
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock returns the current time in the evaluation timezone
+type SystemClock struct {
+	Location *time.Location
+}
+
+func (c SystemClock) Now() time.Time {
+	if c.Location == nil {
+		return time.Now()
+	}
+	return time.Now().In(c.Location)
+}
+
+// FixedClock always returns the same time, e.g. for point-in-time evaluation
+// and tests
+type FixedClock time.Time
+
+func (c FixedClock) Now() time.Time {
+	return time.Time(c)
+}
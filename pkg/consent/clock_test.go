@@ -0,0 +1,20 @@
+package consent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSystemClock(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Berlin")
+
+	now := SystemClock{Location: loc}.Now()
+
+	assert.Equal(t, loc, now.Location())
+	assert.WithinDuration(t, time.Now(), now, time.Second)
+}
+
+func TestFixedClock(t *testing.T) {
+	assert.Equal(t, testNow, FixedClock(testNow).Now())
+}
@@ -0,0 +1,81 @@
+package consent
+
+import (
+	"fmt"
+	"time"
+)
+
+// precision of a FHIR date or dateTime
+type precision int
+
+const (
+	yearPrecision precision = iota
+	monthPrecision
+	dayPrecision
+	timePrecision
+)
+
+// FHIR date, dateTime and instant layouts. Fractional seconds are accepted
+// by time.Parse without being part of the layout.
+var dateTimeLayouts = []struct {
+	layout    string
+	precision precision
+}{
+	{time.RFC3339, timePrecision},
+	{"2006-01-02T15:04:05", timePrecision},
+	{"2006-01-02T15:04", timePrecision},
+	{time.DateOnly, dayPrecision},
+	{"2006-01", monthPrecision},
+	{"2006", yearPrecision},
+}
+
+// parseDateTime parses a FHIR date, dateTime or instant with partial
+// precision (year, year-month, date or date-time). Values without timezone
+// are interpreted in the given location.
+func parseDateTime(s string, loc *time.Location) (time.Time, precision, error) {
+	for _, l := range dateTimeLayouts {
+		if t, err := time.ParseInLocation(l.layout, s, loc); err == nil {
+			return t, l.precision, nil
+		}
+	}
+
+	return time.Time{}, 0, fmt.Errorf("invalid FHIR dateTime: '%s'", s)
+}
+
+// parseStart parses the beginning of a FHIR dateTime. Missing values result
+// in nil.
+func parseStart(s *string, loc *time.Location) (*time.Time, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	t, _, err := parseDateTime(*s, loc)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// parseEnd parses the end of a FHIR dateTime, e.g. a period ending at
+// '2028-09' is valid until the end of September. Missing values result in
+// nil.
+func parseEnd(s *string, loc *time.Location) (*time.Time, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	t, p, err := parseDateTime(*s, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p {
+	case yearPrecision:
+		t = t.AddDate(1, 0, 0)
+	case monthPrecision:
+		t = t.AddDate(0, 1, 0)
+	case dayPrecision:
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
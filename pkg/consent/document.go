@@ -0,0 +1,267 @@
+package consent
+
+import (
+	"consented/pkg/identity"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	LoincSystem        = "http://loinc.org"
+	ConsentScopeSystem = "http://terminology.hl7.org/CodeSystem/consentscope"
+	// consentDocumentCode is the LOINC code of patient consent documents
+	consentDocumentCode = "59284-0"
+)
+
+// ErrInvalidDecision is returned for decisions, which don't match the
+// domain's template
+var ErrInvalidDecision = errors.New("invalid consent decision")
+
+// Decision is a patient's consent decision to be recorded in gICS
+type Decision struct {
+	SignerId identity.Identifier
+	// Template name (optional, if the version is unique) and version
+	Template        string
+	TemplateVersion string
+	Signed          time.Time
+	Policies        []PolicyDecision
+	// Author recording the decision, e.g. the API client
+	Author string
+}
+
+// PolicyDecision permits or denies a policy of the template
+type PolicyDecision struct {
+	Code   string
+	Permit bool
+}
+
+// ErrNoWithdrawalTemplate is returned, if the domain's withdrawal template is
+// unknown
+var ErrNoWithdrawalTemplate = errors.New("domain has no withdrawal template")
+
+// NewConsentDocument validates the decision against the domain's templates
+// and builds the FHIR consent document (Composition, Patient and Consent)
+func NewConsentDocument(d Decision, qs []fhir.Questionnaire) (*fhir.Bundle, error) {
+	q, err := findTemplate(qs, d.Template, d.TemplateVersion)
+	if err != nil {
+		return nil, err
+	}
+	return newDocument(d, *q)
+}
+
+// NewWithdrawalDocument builds the consent document of the domain's withdrawal
+// template, which denies all of its policies. Template and policies of the
+// decision are ignored.
+func NewWithdrawalDocument(d Decision, domain Domain, qs []fhir.Questionnaire) (*fhir.Bundle, error) {
+	q := findWithdrawalTemplate(qs, domain.WithdrawalUri)
+	if q == nil {
+		return nil, ErrNoWithdrawalTemplate
+	}
+
+	d.Template, d.TemplateVersion, d.Policies = templateName(*q), *q.Version, nil
+	for code := range templateCodings(q.Item, make(map[string]fhir.Coding)) {
+		d.Policies = append(d.Policies, PolicyDecision{Code: code, Permit: false})
+	}
+	// stable order of provisions
+	sort.Slice(d.Policies, func(i, j int) bool { return d.Policies[i].Code < d.Policies[j].Code })
+
+	return newDocument(d, *q)
+}
+
+// newDocument validates the decision's policies against the template and
+// builds the document
+func newDocument(d Decision, q fhir.Questionnaire) (*fhir.Bundle, error) {
+	uri := templateUri(q)
+	if uri == nil {
+		return nil, fmt.Errorf("%w: template '%s' (%s) has no url", ErrInvalidDecision, templateName(q), d.TemplateVersion)
+	}
+
+	codings := templateCodings(q.Item, make(map[string]fhir.Coding))
+	signed := d.Signed.Format(time.RFC3339)
+	provisions := make([]fhir.ConsentProvision, 0, len(d.Policies))
+	decided := make(map[string]bool)
+	for _, p := range d.Policies {
+		co, ok := codings[p.Code]
+		if !ok {
+			return nil, fmt.Errorf("%w: policy '%s' is not part of template '%s' (%s)", ErrInvalidDecision, p.Code, templateName(q), d.TemplateVersion)
+		}
+		if decided[p.Code] {
+			return nil, fmt.Errorf("%w: duplicate policy '%s'", ErrInvalidDecision, p.Code)
+		}
+		decided[p.Code] = true
+
+		t := fhir.ConsentProvisionTypeDeny
+		if p.Permit {
+			t = fhir.ConsentProvisionTypePermit
+		}
+		provisions = append(provisions, fhir.ConsentProvision{
+			Type:   &t,
+			Period: &fhir.Period{Start: &signed},
+			Code:   []fhir.CodeableConcept{{Coding: []fhir.Coding{{System: co.System, Code: co.Code, Display: co.Display}}}},
+		})
+	}
+	if len(provisions) == 0 {
+		return nil, fmt.Errorf("%w: missing policies", ErrInvalidDecision)
+	}
+
+	patientUrl, consentUrl, compositionUrl := "urn:uuid:"+newUuid(), "urn:uuid:"+newUuid(), "urn:uuid:"+newUuid()
+	loinc, code, display, scope := LoincSystem, consentDocumentCode, "Patient Consent", "research"
+	consentType := []fhir.Coding{{System: &loinc, Code: &code, Display: &display}}
+
+	patient, err := fhir.Patient{
+		Identifier: []fhir.Identifier{{System: &d.SignerId.System, Value: &d.SignerId.Value}},
+	}.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	deny, scopeSystem := fhir.ConsentProvisionTypeDeny, ConsentScopeSystem
+	consent, err := fhir.Consent{
+		Status:   fhir.ConsentStateActive,
+		Scope:    fhir.CodeableConcept{Coding: []fhir.Coding{{System: &scopeSystem, Code: &scope}}},
+		Category: []fhir.CodeableConcept{{Coding: consentType}},
+		Patient:  &fhir.Reference{Reference: &patientUrl},
+		DateTime: &signed,
+		Policy:   []fhir.ConsentPolicy{{Uri: uri}},
+		// policies not permitted explicitly are denied
+		Provision: &fhir.ConsentProvision{Type: &deny, Period: &fhir.Period{Start: &signed}, Provision: provisions},
+	}.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var authors []fhir.Reference
+	if d.Author != "" {
+		authors = append(authors, fhir.Reference{Display: &d.Author})
+	}
+	composition, err := marshalComposition(fhir.Composition{
+		Status:  fhir.CompositionStatusFinal,
+		Type:    fhir.CodeableConcept{Coding: consentType},
+		Subject: &fhir.Reference{Reference: &patientUrl},
+		Date:    signed,
+		Author:  authors,
+		Title:   templateName(q),
+		Section: []fhir.CompositionSection{{Entry: []fhir.Reference{{Reference: &consentUrl}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &fhir.Bundle{
+		Type:      fhir.BundleTypeDocument,
+		Timestamp: &signed,
+		Entry: []fhir.BundleEntry{
+			{FullUrl: &compositionUrl, Resource: composition},
+			{FullUrl: &patientUrl, Resource: patient},
+			{FullUrl: &consentUrl, Resource: consent},
+		},
+	}, nil
+}
+
+// marshalComposition serializes the composition. Author and title are omitted,
+// if empty (the model always serializes them).
+func marshalComposition(c fhir.Composition) ([]byte, error) {
+	data, err := c.MarshalJSON()
+	if err != nil || (len(c.Author) > 0 && c.Title != "") {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if len(c.Author) == 0 {
+		delete(fields, "author")
+	}
+	if c.Title == "" {
+		delete(fields, "title")
+	}
+	return json.Marshal(fields)
+}
+
+// findTemplate returns the domain's consent template with the version and,
+// if set, the name
+func findTemplate(qs []fhir.Questionnaire, name string, version string) (*fhir.Questionnaire, error) {
+	var found []fhir.Questionnaire
+	for _, q := range qs {
+		if isWithdrawalTemplate(q) || q.Version == nil || *q.Version != version {
+			continue
+		}
+		if name != "" && templateName(q) != name {
+			continue
+		}
+		found = append(found, q)
+	}
+
+	switch len(found) {
+	case 0:
+		if name == "" {
+			return nil, fmt.Errorf("%w: template version '%s' not found", ErrInvalidDecision, version)
+		}
+		return nil, fmt.Errorf("%w: template '%s' (%s) not found", ErrInvalidDecision, name, version)
+	case 1:
+		return &found[0], nil
+	}
+	return nil, fmt.Errorf("%w: template version '%s' is ambiguous, template name required", ErrInvalidDecision, version)
+}
+
+// findWithdrawalTemplate returns the withdrawal template with the uri as
+// resolved by withdrawalUri
+func findWithdrawalTemplate(qs []fhir.Questionnaire, uri string) *fhir.Questionnaire {
+	if uri == "" {
+		return nil
+	}
+	for _, q := range qs {
+		if isWithdrawalTemplate(q) && q.Url != nil && q.Version != nil && path.Base(*q.Url) == uri {
+			return &q
+		}
+	}
+	return nil
+}
+
+// templateCodings returns the policy codings of the template items by code
+func templateCodings(items []fhir.QuestionnaireItem, codings map[string]fhir.Coding) map[string]fhir.Coding {
+	for _, item := range items {
+		for _, co := range item.Code {
+			if co.Code != nil {
+				codings[*co.Code] = co
+			}
+		}
+		templateCodings(item.Item, codings)
+	}
+	return codings
+}
+
+func templateName(q fhir.Questionnaire) string {
+	if q.Name != nil {
+		return *q.Name
+	}
+	if q.Title != nil {
+		return *q.Title
+	}
+	return ""
+}
+
+// templateUri is the canonical url of the template including its version
+func templateUri(q fhir.Questionnaire) *string {
+	if q.Url == nil {
+		return nil
+	}
+	uri := *q.Url + "|" + *q.Version
+	return &uri
+}
+
+// newUuid returns a random (version 4) UUID
+func newUuid() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
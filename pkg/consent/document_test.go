@@ -0,0 +1,144 @@
+package consent
+
+import (
+	"consented/pkg/identity"
+	"encoding/json"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func documentTemplate(name string, version string, codes ...string) fhir.Questionnaire {
+	q := fhir.Questionnaire{
+		Url:     of("https://ths-greifswald.de/fhir/gics/Questionnaire/" + name),
+		Name:    of(name),
+		Version: of(version),
+	}
+	for _, code := range codes {
+		q.Item = append(q.Item, fhir.QuestionnaireItem{
+			LinkId: code,
+			Code:   []fhir.Coding{{System: of("https://ths-greifswald.de/fhir/CodeSystem/gics/Policy/MII"), Code: of(code)}},
+		})
+	}
+	return q
+}
+
+func TestNewConsentDocument(t *testing.T) {
+	qs := []fhir.Questionnaire{documentTemplate("Broad Consent", "1.6.d", "IDAT_erheben", "MDAT_erheben")}
+	d := Decision{
+		SignerId:        identity.Identifier{System: "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID", Value: "42"},
+		TemplateVersion: "1.6.d",
+		Signed:          time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		Policies:        []PolicyDecision{{Code: "IDAT_erheben", Permit: true}, {Code: "MDAT_erheben", Permit: false}},
+		Author:          "registry",
+	}
+
+	doc, err := NewConsentDocument(d, qs)
+	assert.NoError(t, err)
+	assert.Equal(t, fhir.BundleTypeDocument, doc.Type)
+	assert.Len(t, doc.Entry, 3)
+
+	composition, _ := fhir.UnmarshalComposition(doc.Entry[0].Resource)
+	assert.Equal(t, "registry", *composition.Author[0].Display)
+	assert.Equal(t, *doc.Entry[1].FullUrl, *composition.Subject.Reference)
+	assert.Equal(t, *doc.Entry[2].FullUrl, *composition.Section[0].Entry[0].Reference)
+
+	patient, _ := fhir.UnmarshalPatient(doc.Entry[1].Resource)
+	assert.Equal(t, "42", *patient.Identifier[0].Value)
+
+	c, _ := fhir.UnmarshalConsent(doc.Entry[2].Resource)
+	assert.Equal(t, "https://ths-greifswald.de/fhir/gics/Questionnaire/Broad Consent|1.6.d", *c.Policy[0].Uri)
+	assert.Equal(t, "2024-06-01T00:00:00Z", *c.DateTime)
+	assert.Equal(t, fhir.ConsentProvisionTypeDeny, *c.Provision.Type)
+	assert.Len(t, c.Provision.Provision, 2)
+	assert.Equal(t, fhir.ConsentProvisionTypePermit, *c.Provision.Provision[0].Type)
+	assert.Equal(t, "IDAT_erheben", *c.Provision.Provision[0].Code[0].Coding[0].Code)
+	assert.Equal(t, fhir.ConsentProvisionTypeDeny, *c.Provision.Provision[1].Type)
+}
+
+func TestNewConsentDocumentInvalid(t *testing.T) {
+	qs := []fhir.Questionnaire{
+		documentTemplate("Broad Consent", "1.6.d", "IDAT_erheben", "MDAT_erheben"),
+		documentTemplate("Biobank", "1.0", "BIOMAT_erheben"),
+		documentTemplate("Study", "1.0", "IDAT_erheben"),
+	}
+	permit := []PolicyDecision{{Code: "IDAT_erheben", Permit: true}}
+
+	cases := []struct {
+		name     string
+		template string
+		version  string
+		policies []PolicyDecision
+		expected string
+	}{
+		{"unknownPolicy", "", "1.6.d", []PolicyDecision{{Code: "BIOMAT_erheben", Permit: true}}, "invalid consent decision: policy 'BIOMAT_erheben' is not part of template 'Broad Consent' (1.6.d)"},
+		{"duplicatePolicy", "", "1.6.d", []PolicyDecision{permit[0], permit[0]}, "invalid consent decision: duplicate policy 'IDAT_erheben'"},
+		{"missingPolicies", "", "1.6.d", nil, "invalid consent decision: missing policies"},
+		{"unknownVersion", "", "2.0", permit, "invalid consent decision: template version '2.0' not found"},
+		{"unknownTemplate", "Other", "1.0", permit, "invalid consent decision: template 'Other' (1.0) not found"},
+		{"ambiguousVersion", "", "1.0", permit, "invalid consent decision: template version '1.0' is ambiguous, template name required"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewConsentDocument(Decision{Template: c.template, TemplateVersion: c.version, Policies: c.policies}, qs)
+
+			assert.ErrorIs(t, err, ErrInvalidDecision)
+			assert.EqualError(t, err, c.expected)
+		})
+	}
+
+	// templates without url can't be referenced
+	noUrl := documentTemplate("Other", "2.0", "IDAT_erheben")
+	noUrl.Url = nil
+	_, err := NewConsentDocument(Decision{TemplateVersion: "2.0", Policies: permit}, []fhir.Questionnaire{noUrl})
+	assert.ErrorIs(t, err, ErrInvalidDecision)
+
+	// template name resolves the ambiguous version
+	_, err = NewConsentDocument(Decision{Template: "Study", TemplateVersion: "1.0", Policies: permit}, qs)
+	assert.NoError(t, err)
+}
+
+func TestNewConsentDocumentWithoutAuthor(t *testing.T) {
+	q := documentTemplate("Broad Consent", "1.6.d", "IDAT_erheben")
+	q.Name = nil
+	d := Decision{TemplateVersion: "1.6.d", Policies: []PolicyDecision{{Code: "IDAT_erheben", Permit: true}}}
+
+	doc, err := NewConsentDocument(d, []fhir.Questionnaire{q})
+	assert.NoError(t, err)
+
+	var composition map[string]any
+	assert.NoError(t, json.Unmarshal(doc.Entry[0].Resource, &composition))
+	assert.Equal(t, "Composition", composition["resourceType"])
+	assert.NotContains(t, composition, "author")
+	assert.NotContains(t, composition, "title")
+}
+
+func TestNewWithdrawalDocument(t *testing.T) {
+	withdrawal := documentTemplate("Widerruf", "2.0.a", "MDAT_erheben", "IDAT_erheben")
+	withdrawal.Code = []fhir.Coding{{System: of(TemplateType), Code: of("WITHDRAWAL")}}
+	qs := []fhir.Questionnaire{documentTemplate("Broad Consent", "1.6.d", "IDAT_erheben", "MDAT_erheben"), withdrawal}
+	d := Decision{
+		SignerId: identity.Identifier{System: "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID", Value: "42"},
+		Signed:   time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		Policies: []PolicyDecision{{Code: "MDAT_erheben", Permit: true}},
+	}
+
+	doc, err := NewWithdrawalDocument(d, Domain{Name: "MII", WithdrawalUri: "Widerruf"}, qs)
+	assert.NoError(t, err)
+
+	c, _ := fhir.UnmarshalConsent(doc.Entry[2].Resource)
+	assert.Equal(t, "https://ths-greifswald.de/fhir/gics/Questionnaire/Widerruf|2.0.a", *c.Policy[0].Uri)
+	assert.Len(t, c.Provision.Provision, 2)
+	for i, code := range []string{"IDAT_erheben", "MDAT_erheben"} {
+		assert.Equal(t, fhir.ConsentProvisionTypeDeny, *c.Provision.Provision[i].Type)
+		assert.Equal(t, code, *c.Provision.Provision[i].Code[0].Coding[0].Code)
+	}
+
+	// consent templates are no withdrawal templates
+	_, err = NewWithdrawalDocument(d, Domain{Name: "MII", WithdrawalUri: "Broad Consent"}, qs)
+	assert.ErrorIs(t, err, ErrNoWithdrawalTemplate)
+	_, err = NewWithdrawalDocument(d, Domain{Name: "MII"}, qs)
+	assert.ErrorIs(t, err, ErrNoWithdrawalTemplate)
+}
@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,36 +19,74 @@ const (
 )
 
 type Domain struct {
-	Name            string
-	Description     string
+	Name        string
+	Description string
+	// CheckPolicyCode is the checkPolicy expression (see CheckPolicy)
 	CheckPolicyCode string
-	PersonIdSystem  string
+	CheckPolicy     CheckPolicy
+	// PersonIdSystem is the primary signer id system
+	PersonIdSystem string
+	// PersonIdSystems are all signer id systems of the domain
+	PersonIdSystems []string
 	Departments     []string
 	WithdrawalUri   string
 	DocumentRef     *string
+	// AskConsentBefore is the period before expiry of the check policy, in
+	// which the patient should be asked for consent again
+	AskConsentBefore Period
+	// ReaskDeclinedAfter is the grace period after which patients who
+	// declined can be asked again (nil: never)
+	ReaskDeclinedAfter *Period
+	// ReaskWithdrawn allows to ask patients again after withdrawal
+	ReaskWithdrawn bool
+	// Modules of the domain's consent templates
+	Modules []Module
+	// AcceptedQcStates are the quality control types of valid consents
+	// (nil: default mapping, see qcStatus)
+	AcceptedQcStates []string
 }
 
 func (d Domain) String() string {
 	return d.Name
 }
 
+// checkPolicy returns the parsed checkPolicy expression
+func (d Domain) checkPolicy() (CheckPolicy, error) {
+	if d.CheckPolicy != nil {
+		return d.CheckPolicy, nil
+	}
+	return ParseCheckPolicy(d.CheckPolicyCode)
+}
+
+// Defaults are domain settings used if not configured via external properties
+type Defaults struct {
+	AskConsentBefore Period
+}
+
 type DomainCache struct {
 	Domains        []Domain
 	Client         GicsClient
 	UpdateInterval time.Duration
+	Defaults       Defaults
 	Initialized    bool
 	IsHealthy      bool
+	// serializes periodic and triggered updates
+	mu sync.Mutex
+	// guards reading and replacing the domains
+	rw sync.RWMutex
+	// a refresh is waiting for the running one
+	pending atomic.Bool
 }
 
-func NewDomainCache(c GicsClient, interval time.Duration) *DomainCache {
-	return &DomainCache{Client: c, UpdateInterval: interval}
+func NewDomainCache(c GicsClient, interval time.Duration, defaults Defaults) *DomainCache {
+	return &DomainCache{Client: c, UpdateInterval: interval, Defaults: defaults}
 }
 
 func (d *DomainCache) Initialize() chan bool {
 
 	// initial call
-	d.IsHealthy = d.updateCache()
-	log.Info().Int("domains", len(d.Domains)).Str("update-interval", d.UpdateInterval.String()).
+	d.Refresh()
+	log.Info().Int("domains", len(d.List())).Str("update-interval", d.UpdateInterval.String()).
 		Msg("Successfully initialized domains. Updating periodically.")
 
 	// init polling
@@ -54,7 +96,7 @@ func (d *DomainCache) Initialize() chan bool {
 		for {
 			select {
 			case <-ticker.C:
-				d.IsHealthy = d.updateCache()
+				d.Refresh()
 			case <-quit:
 				ticker.Stop()
 				return
@@ -64,12 +106,49 @@ func (d *DomainCache) Initialize() chan bool {
 	return quit
 }
 
-func (d *DomainCache) updateCache() bool {
+// Refresh updates the domains from gICS, e.g. after gICS notified about
+// changed domains. Refreshes requested while one is waiting are coalesced
+// into the waiting one, so at most one runs and one waits.
+func (d *DomainCache) Refresh() {
+	if !d.pending.CompareAndSwap(false, true) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// requests from now on need another refresh
+	d.pending.Store(false)
+
+	domains, ok := d.fetchDomains()
+	d.rw.Lock()
+	defer d.rw.Unlock()
+	if ok {
+		d.Domains = domains
+		log.Debug().Str("domains", fmt.Sprintf("%s", domains)).Msg("Updated domain cache")
+	}
+	d.IsHealthy = ok
+}
+
+// List returns the cached domains. Refreshes replace the slice instead of
+// modifying it, so it is safe to use after returning.
+func (d *DomainCache) List() []Domain {
+	d.rw.RLock()
+	defer d.rw.RUnlock()
+	return d.Domains
+}
+
+// Healthy is true, if the last refresh succeeded
+func (d *DomainCache) Healthy() bool {
+	d.rw.RLock()
+	defer d.rw.RUnlock()
+	return d.IsHealthy
+}
+
+func (d *DomainCache) fetchDomains() ([]Domain, bool) {
 	// get domains
 	rs, err := d.Client.GetDomains()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to update domain cache. Data might be out of date.")
-		return false
+		return nil, false
 	}
 
 	// build domain structs
@@ -87,13 +166,13 @@ func (d *DomainCache) updateCache() bool {
 		// name & description
 		domain := Domain{Name: name, Description: desc}
 
-		// parse id system
-		ctxId := parseIdSystem(s.Extension)
-		if ctxId != nil {
-			domain.PersonIdSystem = *ctxId
-		} else {
+		// parse id systems, the first one is primary
+		systems := parseIdSystems(s.Extension)
+		if len(systems) == 0 {
 			continue
 		}
+		domain.PersonIdSystem = systems[0]
+		domain.PersonIdSystems = systems
 
 		// external properties
 		props := parseExternalProperty(s.Extension)
@@ -106,38 +185,95 @@ func (d *DomainCache) updateCache() bool {
 			domain.DocumentRef = &val
 		}
 
+		// askConsentBefore is optional
+		domain.AskConsentBefore = d.Defaults.AskConsentBefore
+		if val, ok := props["askConsentBefore"]; ok {
+			if p, err := ParsePeriod(val); err == nil {
+				domain.AskConsentBefore = p
+			} else {
+				log.Error().Err(err).Str("domain", domain.Name).Str("property", "askConsentBefore").Msg("Failed to parse external property from gICS domain. Using default")
+			}
+		}
+
+		// re-ask rules are optional
+		if val, ok := props["reaskDeclinedAfter"]; ok {
+			if p, err := ParsePeriod(val); err == nil {
+				domain.ReaskDeclinedAfter = &p
+			} else {
+				log.Error().Err(err).Str("domain", domain.Name).Str("property", "reaskDeclinedAfter").Msg("Failed to parse external property from gICS domain")
+			}
+		}
+		if val, ok := props["reaskWithdrawn"]; ok {
+			if b, err := strconv.ParseBool(val); err == nil {
+				domain.ReaskWithdrawn = b
+			} else {
+				log.Error().Err(err).Str("domain", domain.Name).Str("property", "reaskWithdrawn").Msg("Failed to parse external property from gICS domain")
+			}
+		}
+
+		// accepted quality control states are optional
+		if val, ok := props["acceptedQcStates"]; ok {
+			domain.AcceptedQcStates = parseList(val)
+		}
+
 		// checkPolicy is required
 		if val, ok := props["checkPolicy"]; ok {
+			expr, err := ParseCheckPolicy(val)
+			if err != nil {
+				log.Error().Err(err).Str("domain", domain.Name).Str("property", "checkPolicy").Msg("Failed to parse external property from gICS domain")
+				continue
+			}
 			domain.CheckPolicyCode = val
+			domain.CheckPolicy = expr
 		} else {
 			log.Error().Str("domain", domain.Name).Str("property", "checkPolicy").Msg("Failed to parse external property from gICS domain")
 			continue
 		}
 
-		// check withdrawal template uri
-		domain.WithdrawalUri = d.Client.GetTemplate(domain.Name, "WITHDRAWAL")
+		// withdrawal template and modules are optional
+		if qs, err := d.Client.GetQuestionnaires(domain.Name); err == nil {
+			domain.WithdrawalUri = withdrawalUri(qs)
+			domain.Modules = parseModules(qs)
+		} else {
+			log.Error().Err(err).Str("domain", domain.Name).Msg("Failed to resolve withdrawal template and modules from gICS templates")
+		}
 
 		result = append(result, domain)
 	}
+	return result, true
+}
 
-	d.Domains = result
-	log.Debug().Str("domains", fmt.Sprintf("%s", d.Domains)).Msg("Updated domain cache")
-	return true
+// parseList splits a comma separated property value
+func parseList(val string) []string {
+	result := make([]string, 0)
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
 }
 
-func parseIdSystem(ext []fhir.Extension) *string {
+func parseIdSystems(ext []fhir.Extension) []string {
+	var systems []string
 	for _, e := range ext {
 		if e.Url != ContextIdentifierElementSystem {
 			continue
 		}
 
 		for _, ee := range e.Extension {
-			if ee.Url == "system" {
-				return ee.ValueUri
+			if ee.Url == "system" && ee.ValueUri != nil && !slices.Contains(systems, *ee.ValueUri) {
+				systems = append(systems, *ee.ValueUri)
 			}
 		}
 	}
-	return nil
+	return systems
+}
+
+// AcceptsSignerIdSystem is true, if the system is one of the domain's signer
+// id systems
+func (d Domain) AcceptsSignerIdSystem(system string) bool {
+	return system == d.PersonIdSystem || slices.Contains(d.PersonIdSystems, system)
 }
 
 func parseExternalProperty(ext []fhir.Extension) map[string]string {
@@ -1,6 +1,7 @@
 package consent
 
 import (
+	"consented/pkg/identity"
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -9,30 +10,109 @@ import (
 
 func TestInitialize(t *testing.T) {
 	c := &TestGicsClient{}
-	d := NewDomainCache(c, 1*time.Hour)
+	d := NewDomainCache(c, 1*time.Hour, Defaults{AskConsentBefore: Period{Years: 1}})
 
 	// act
 	d.Initialize()
 
 	expected := []Domain{
 		{
-			Name:            "Foo",
-			Description:     "Foo Domain",
-			CheckPolicyCode: "MDAT_erheben",
-			PersonIdSystem:  "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID",
+			Name:             "Foo",
+			Description:      "Foo Domain",
+			CheckPolicyCode:  "MDAT_erheben",
+			CheckPolicy:      CheckPolicy{{"MDAT_erheben"}},
+			PersonIdSystem:   "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID",
+			PersonIdSystems:  []string{"https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID"},
+			AskConsentBefore: Period{Years: 1},
 		},
 		{
-			Name:            "Bar",
-			Description:     "Bar Domain",
-			DocumentRef:     of("bar-doc-id"),
-			CheckPolicyCode: "MDAT_erheben",
-			PersonIdSystem:  "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID",
-			Departments:     []string{"bar-dep"},
+			Name:               "Bar",
+			Description:        "Bar Domain",
+			DocumentRef:        of("bar-doc-id"),
+			CheckPolicyCode:    "IDAT_erheben&MDAT_erheben|Broad_Consent",
+			CheckPolicy:        CheckPolicy{{"IDAT_erheben", "MDAT_erheben"}, {"Broad_Consent"}},
+			PersonIdSystem:     "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID",
+			PersonIdSystems:    []string{"https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID", "https://ths-greifswald.de/fhir/gics/identifiers/Pseudonym"},
+			Departments:        []string{"bar-dep"},
+			AskConsentBefore:   Period{Months: 6},
+			ReaskDeclinedAfter: &Period{Years: 2},
+			ReaskWithdrawn:     true,
+			WithdrawalUri:      "Widerruf",
+			Modules: []Module{
+				{Name: "Patientendaten erheben", Policies: []string{"IDAT_erheben", "MDAT_erheben"}},
+				{Name: "Rekontaktierung", Policies: []string{"Rekontaktierung_Ergaenzungen"}},
+			},
+			AcceptedQcStates: []string{"checked_no_faults", "not_checked"},
 		}}
 
 	assert.EqualValues(t, expected, d.Domains)
 }
 
+func TestRefreshCoalesced(t *testing.T) {
+	c := &slowGicsClient{started: make(chan bool), release: make(chan bool)}
+	d := NewDomainCache(c, 1*time.Hour, Defaults{})
+
+	running := make(chan bool)
+	go func() {
+		d.Refresh()
+		running <- true
+	}()
+	<-c.started
+
+	// waits for the running refresh
+	waiting := make(chan bool)
+	go func() {
+		d.Refresh()
+		waiting <- true
+	}()
+	assert.Eventually(t, d.pending.Load, time.Second, time.Millisecond)
+
+	// coalesced into the waiting one
+	d.Refresh()
+	d.Refresh()
+
+	close(c.release)
+	<-running
+	<-c.started
+	<-waiting
+	assert.Equal(t, 2, c.calls)
+}
+
+func TestListWhileRefreshing(t *testing.T) {
+	d := NewDomainCache(&TestGicsClient{}, 1*time.Hour, Defaults{})
+
+	done := make(chan bool)
+	go func() {
+		d.Refresh()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			assert.Len(t, d.List(), 2)
+			assert.True(t, d.Healthy())
+			return
+		default:
+			_ = d.List()
+		}
+	}
+}
+
+// slowGicsClient blocks fetching domains until released
+type slowGicsClient struct {
+	TestGicsClient
+	started chan bool
+	release chan bool
+	calls   int
+}
+
+func (c *slowGicsClient) GetDomains() ([]fhir.ResearchStudy, error) {
+	c.calls++
+	c.started <- true
+	<-c.release
+	return nil, nil
+}
+
 type TestGicsClient struct{}
 
 func (c *TestGicsClient) GetDomains() ([]fhir.ResearchStudy, error) {
@@ -61,11 +141,18 @@ func (c *TestGicsClient) GetDomains() ([]fhir.ResearchStudy, error) {
 			Identifier:  []fhir.Identifier{{Value: of("Bar")}},
 			Description: of("Bar Domain"),
 			Extension: []fhir.Extension{signerId,
+				{
+					Url: ContextIdentifierElementSystem,
+					Extension: []fhir.Extension{{
+						Url:      "system",
+						ValueUri: of("https://ths-greifswald.de/fhir/gics/identifiers/Pseudonym"),
+					}},
+				},
 				{
 					Url: ExternalPropertyElementSystem,
 					Extension: []fhir.Extension{
 						{Url: "key", ValueString: of("checkPolicy")},
-						{Url: "value", ValueString: of("MDAT_erheben")},
+						{Url: "value", ValueString: of("IDAT_erheben&MDAT_erheben|Broad_Consent")},
 					},
 				},
 				{
@@ -82,6 +169,34 @@ func (c *TestGicsClient) GetDomains() ([]fhir.ResearchStudy, error) {
 						{Url: "value", ValueString: of("bar-doc-id")},
 					},
 				},
+				{
+					Url: ExternalPropertyElementSystem,
+					Extension: []fhir.Extension{
+						{Url: "key", ValueString: of("askConsentBefore")},
+						{Url: "value", ValueString: of("P6M")},
+					},
+				},
+				{
+					Url: ExternalPropertyElementSystem,
+					Extension: []fhir.Extension{
+						{Url: "key", ValueString: of("reaskDeclinedAfter")},
+						{Url: "value", ValueString: of("P2Y")},
+					},
+				},
+				{
+					Url: ExternalPropertyElementSystem,
+					Extension: []fhir.Extension{
+						{Url: "key", ValueString: of("reaskWithdrawn")},
+						{Url: "value", ValueString: of("true")},
+					},
+				},
+				{
+					Url: ExternalPropertyElementSystem,
+					Extension: []fhir.Extension{
+						{Url: "key", ValueString: of("acceptedQcStates")},
+						{Url: "value", ValueString: of("checked_no_faults, not_checked")},
+					},
+				},
 			},
 		},
 		{
@@ -116,7 +231,17 @@ func (c *TestGicsClient) GetDomains() ([]fhir.ResearchStudy, error) {
 	}, nil
 }
 
-func (c *TestGicsClient) GetConsentPolicies(_ string, _ Domain) (*fhir.Bundle, error) {
+func (c *TestGicsClient) GetConsentPolicies(_ identity.Identifier, _ Domain) (*fhir.Bundle, error) {
+
+	return &fhir.Bundle{}, nil
+}
+
+func (c *TestGicsClient) GetConsentPoliciesAt(_ identity.Identifier, _ Domain, _ time.Time) (*fhir.Bundle, error) {
+
+	return &fhir.Bundle{}, nil
+}
+
+func (c *TestGicsClient) GetConsents(_ identity.Identifier, _ Domain) (*fhir.Bundle, error) {
 
 	return &fhir.Bundle{}, nil
 }
@@ -125,6 +250,45 @@ func (c *TestGicsClient) GetTemplate(_ string, _ string) string {
 	return ""
 }
 
+func (c *TestGicsClient) GetQuestionnaires(domain string) ([]fhir.Questionnaire, error) {
+	if domain != "Bar" {
+		return nil, nil
+	}
+
+	return []fhir.Questionnaire{
+		{
+			Item: []fhir.QuestionnaireItem{
+				{
+					LinkId: "1",
+					Text:   of("Patientendaten erheben"),
+					Code:   []fhir.Coding{{Code: of("IDAT_erheben")}, {Code: of("MDAT_erheben")}},
+				},
+				{
+					LinkId: "2",
+					Item: []fhir.QuestionnaireItem{{
+						LinkId: "2.1",
+						Text:   of("Rekontaktierung"),
+						Code:   []fhir.Coding{{Code: of("Rekontaktierung_Ergaenzungen")}},
+					}},
+				},
+			},
+		},
+		{
+			Url:  of("https://ths-greifswald.de/fhir/gics/Questionnaire/Widerruf"),
+			Code: []fhir.Coding{{System: of(TemplateType), Code: of("WITHDRAWAL")}},
+			Item: []fhir.QuestionnaireItem{{
+				LinkId: "1",
+				Text:   of("Widerruf"),
+				Code:   []fhir.Coding{{Code: of("IDAT_erheben")}},
+			}},
+		},
+	}, nil
+}
+
 func (c *TestGicsClient) GetSourceReferenceTemplate(ref string) string {
 	return ref
 }
+
+func (c *TestGicsClient) AddConsent(_ Domain, _ *fhir.Bundle) error {
+	return nil
+}
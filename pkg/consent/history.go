@@ -0,0 +1,317 @@
+package consent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"slices"
+	"time"
+)
+
+// history events
+const (
+	EventSigned    = "signed"
+	EventRenewed   = "renewed"
+	EventDeclined  = "declined"
+	EventWithdrawn = "withdrawn"
+	// EventExpired is the expiry of the policies, not a consent
+	EventExpired = "expired"
+	// EventInvalid is a consent, which could not be evaluated
+	EventInvalid = "invalid"
+)
+
+// HistoryEntry is a single consent of a patient's consent history
+type HistoryEntry struct {
+	Date *time.Time `json:"date"`
+	// SourceReference is the QuestionnaireResponse the consent was created from
+	SourceReference *string `json:"source-reference"`
+	Template        *string `json:"template"`
+	// Event classifies the consent itself, e.g. signed or withdrawn
+	Event string `json:"event"`
+	// Reason why the consent is invalid
+	Reason string `json:"reason,omitempty"`
+	// QcState is the quality control type of the consent
+	QcState string `json:"qc-state,omitempty"`
+	// Status of the domain after the consent was given
+	Status   Status   `json:"status"`
+	Policies []Policy `json:"policies"`
+}
+
+// ParseHistory returns the chronological consent history of a patient in the
+// domain. Expiry of the policies is evaluated relative to the clock's time.
+// Invalid consents are reported as entries with event 'invalid', those
+// without valid date at the end. The expiry of the status before the next
+// consent (or now) is reported as entry with event 'expired'. Consents
+// excluded by quality control do not change the status.
+func ParseHistory(b *fhir.Bundle, domain Domain, c GicsClient, clock Clock) ([]HistoryEntry, error) {
+	expr, err := domain.checkPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	now := clock.Now()
+	all := datedConsents(b, now.Location())
+	// consents without date are appended
+	slices.SortStableFunc(all, func(a, b datedConsent) int {
+		switch {
+		case a.date == nil && b.date == nil:
+			return 0
+		case a.date == nil:
+			return 1
+		case b.date == nil:
+			return -1
+		}
+		return a.date.Compare(*b.date)
+	})
+
+	history := make([]HistoryEntry, 0, len(all))
+	// cumulative states of the policies referenced by checkPolicy
+	states := make(map[string]policyState)
+	// policies permitted before
+	permitted := make(map[string]bool)
+	// evaluation after the previous consent
+	last := evaluation{status: NotAsked}
+	// expired adds the expiry of the evaluated status before the given time
+	expired := func(until time.Time) {
+		for last.status == Accepted && !isUnlimited(last.expires) && !last.expires.After(until) {
+			date := last.expires
+			last = expr.evaluate(states, date)
+			history = append(history, HistoryEntry{Date: &date, Event: EventExpired, Status: last.status, Policies: make([]Policy, 0)})
+		}
+	}
+	for _, dc := range all {
+		r := dc.consent
+		if dc.date != nil {
+			expired(*dc.date)
+		} else {
+			expired(now)
+		}
+
+		// invalid consents are reported, the status is unchanged
+		if dc.err != nil {
+			log.Warn().Err(dc.err).Msg("Invalid Consent resource in history")
+			history = append(history, HistoryEntry{
+				Date:            dc.date,
+				SourceReference: sourceReference(r),
+				Event:           EventInvalid,
+				Reason:          dc.err.Error(),
+				Status:          last.status,
+				Policies:        make([]Policy, 0),
+			})
+			continue
+		}
+
+		date := *dc.date
+		e := HistoryEntry{Date: &date, Policies: make([]Policy, 0)}
+		if r.SourceReference != nil && r.SourceReference.Reference != nil {
+			e.SourceReference = r.SourceReference.Reference
+			if t := c.GetSourceReferenceTemplate(*r.SourceReference.Reference); t != "" {
+				e.Template = &t
+			}
+		}
+		withdrawal := isWithdrawal(r, domain, c)
+		// consents excluded by quality control keep the status
+		e.QcState = qcState(r)
+		_, valid := qcStatus(e.QcState, domain.AcceptedQcStates)
+
+		var permits, renewals int
+		for _, p := range dc.policies {
+			p.Date = &date
+			p.Expired = p.IsExpired(now)
+			e.Policies = append(e.Policies, p)
+
+			if p.Permit {
+				permits++
+				if permitted[p.Code] {
+					renewals++
+				}
+				permitted[p.Code] = permitted[p.Code] || valid
+			}
+
+			if valid && expr.Contains(p.Code) {
+				s := p.state(&date)
+				s.withdrawn = !p.Permit && isUnlimited(s.expires) && withdrawal
+				states[p.Code] = s
+			}
+		}
+
+		switch {
+		case withdrawal:
+			e.Event = EventWithdrawn
+		case permits == 0:
+			e.Event = EventDeclined
+		case renewals > 0:
+			e.Event = EventRenewed
+		default:
+			e.Event = EventSigned
+		}
+		if valid {
+			last = expr.evaluate(states, date)
+		}
+		e.Status = last.status
+
+		history = append(history, e)
+	}
+	expired(now)
+
+	return history, nil
+}
+
+// splitProvisions returns a copy of the consent per coding of the nested
+// provisions, i.e. one consent per policy
+func splitProvisions(r fhir.Consent) []fhir.Consent {
+	if r.Provision == nil {
+		return nil
+	}
+
+	provisions := policyProvisions(r.Provision)
+	result := make([]fhir.Consent, 0, len(provisions))
+	for _, p := range provisions {
+		single := r
+		prov := *r.Provision
+		prov.Provision = []fhir.ConsentProvision{p}
+		single.Provision = &prov
+		result = append(result, single)
+	}
+
+	return result
+}
+
+// datedConsent is a consent with its bundle entry, parsed date and policies.
+// Invalid consents have an error instead (and the date, if it could be
+// parsed).
+type datedConsent struct {
+	entry    fhir.BundleEntry
+	consent  fhir.Consent
+	date     *time.Time
+	policies []Policy
+	err      error
+}
+
+// datedConsents returns all consents of the bundle with date and policies.
+// Malformed consents, those with missing or unparsable dates or invalid
+// provisions are returned with the error.
+func datedConsents(b *fhir.Bundle, loc *time.Location) []datedConsent {
+	result := consents(b)
+	for i, dc := range result {
+		if dc.err != nil {
+			continue
+		}
+		r := dc.consent
+		date, err := parseStart(r.DateTime, loc)
+		if err == nil && date == nil {
+			err = errors.New("missing dateTime")
+		}
+		if err != nil {
+			result[i].err = err
+			continue
+		}
+		result[i].date = date
+		result[i].policies, result[i].err = parsePolicies(r.Provision, loc)
+	}
+
+	return result
+}
+
+// sourceReference returns the reference to the consent's QuestionnaireResponse
+func sourceReference(r fhir.Consent) *string {
+	if r.SourceReference == nil {
+		return nil
+	}
+	return r.SourceReference.Reference
+}
+
+// resourceType returns the type of the raw FHIR resource
+func resourceType(raw []byte) string {
+	var r struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return ""
+	}
+	return r.ResourceType
+}
+
+// consents returns all Consent resources of the bundle. Nested bundles (e.g.
+// consent documents) are searched recursively. Malformed resources are
+// returned with the error.
+func consents(b *fhir.Bundle) []datedConsent {
+	result := make([]datedConsent, 0)
+	for _, e := range b.Entry {
+		switch resourceType(e.Resource) {
+		case "Consent":
+			c, err := fhir.UnmarshalConsent(e.Resource)
+			if err != nil {
+				err = fmt.Errorf("malformed Consent resource: %w", err)
+			}
+			result = append(result, datedConsent{entry: e, consent: c, err: err})
+		case "Bundle":
+			if nested, err := fhir.UnmarshalBundle(e.Resource); err == nil {
+				result = append(result, consents(&nested)...)
+			}
+		}
+	}
+
+	return result
+}
+
+// policyStatesAt derives the policy states valid at the given time from all
+// consents of a person. Each policy's state is taken from the latest consent
+// given before or at that time, which passed quality control (see qcStatus
+// with the accepted states). Consents excluded by quality control are only
+// taken for policies without such a consent, so the mapper reports their
+// status. The result has the same layout as gICS' current policy states, i.e.
+// one Consent resource per policy. Invalid consents, which may precede that
+// time, are included as is to be reported by the mapper.
+func policyStatesAt(b *fhir.Bundle, at time.Time, accepted []string) *fhir.Bundle {
+	var codes []string
+	latest := make(map[string]fhir.Consent)
+	dates := make(map[string]time.Time)
+	// whether the latest consent passed quality control
+	passed := make(map[string]bool)
+	var invalid []fhir.BundleEntry
+
+	for _, dc := range datedConsents(b, at.Location()) {
+		if dc.date != nil && dc.date.After(at) {
+			continue
+		}
+		if dc.err != nil {
+			invalid = append(invalid, dc.entry)
+			continue
+		}
+		c, date := dc.consent, *dc.date
+		_, valid := qcStatus(qcState(c), accepted)
+
+		for _, single := range splitProvisions(c) {
+			code := *single.Provision.Provision[0].Code[0].Coding[0].Code
+
+			if d, ok := dates[code]; ok {
+				// older or excluded by quality control
+				if passed[code] && !valid || passed[code] == valid && date.Before(d) {
+					continue
+				}
+			} else {
+				codes = append(codes, code)
+			}
+
+			latest[code] = single
+			dates[code] = date
+			passed[code] = valid
+		}
+	}
+
+	result := &fhir.Bundle{Type: fhir.BundleTypeSearchset, Entry: make([]fhir.BundleEntry, 0, len(codes)+len(invalid))}
+	for _, code := range codes {
+		r, err := latest[code].MarshalJSON()
+		if err != nil {
+			log.Error().Err(err).Str("policy", code).Msg("Unable to serialize policy state")
+			continue
+		}
+		result.Entry = append(result.Entry, fhir.BundleEntry{Resource: r})
+	}
+	result.Entry = append(result.Entry, invalid...)
+
+	return result
+}
@@ -0,0 +1,280 @@
+package consent
+
+import (
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPolicyStatesAt(t *testing.T) {
+
+	// consent document with two policies
+	doc, _ := fhir.Bundle{Type: fhir.BundleTypeDocument, Entry: []fhir.BundleEntry{
+		{Resource: historyConsent("2020-01-01T10:00:00Z",
+			historyProvision("IDAT_erheben", fhir.ConsentProvisionTypePermit),
+			historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit))},
+	}}.MarshalJSON()
+	// later withdrawal of a single policy
+	withdrawal := historyConsent("2022-01-01T10:00:00Z",
+		historyProvision("MDAT_erheben", fhir.ConsentProvisionTypeDeny))
+
+	b := &fhir.Bundle{Entry: []fhir.BundleEntry{{Resource: withdrawal}, {Resource: doc}}}
+
+	cases := []struct {
+		name     string
+		at       time.Time
+		expected map[string]bool
+	}{
+		{
+			name:     "beforeConsent",
+			at:       time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+			expected: map[string]bool{},
+		},
+		{
+			name:     "atConsent",
+			at:       time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC),
+			expected: map[string]bool{"IDAT_erheben": true, "MDAT_erheben": true},
+		},
+		{
+			name:     "beforeWithdrawal",
+			at:       time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			expected: map[string]bool{"IDAT_erheben": true, "MDAT_erheben": true},
+		},
+		{
+			name:     "afterWithdrawal",
+			at:       time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+			expected: map[string]bool{"IDAT_erheben": true, "MDAT_erheben": false},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := policyStatesAt(b, c.at, nil)
+
+			actual := make(map[string]bool)
+			for _, e := range res.Entry {
+				r, _ := fhir.UnmarshalConsent(e.Resource)
+				p, err := parsePolicies(r.Provision, time.UTC)
+				assert.NoError(t, err)
+				assert.Len(t, p, 1)
+				actual[p[0].Code] = p[0].Permit
+			}
+
+			assert.Equal(t, c.expected, actual)
+		})
+	}
+}
+
+func TestPolicyStatesAtReportsInvalidConsents(t *testing.T) {
+
+	// withdrawal with unparsable date
+	b := &fhir.Bundle{Entry: []fhir.BundleEntry{
+		{Resource: historyConsent("2020-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit))},
+		{Resource: historyConsent("2022-13-01", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypeDeny))},
+		{Resource: historyConsent("2021-01-01T10:00:00Z")},
+		{Resource: historyConsent("2025-01-01T10:00:00Z")},
+		{Resource: []byte(`{"resourceType":"Consent","status":"bogus"}`)},
+	}}
+	domain := Domain{Name: "MII", CheckPolicyCode: "MDAT_erheben"}
+
+	ds, err := ParseConsent(policyStatesAt(b, testNow, nil), domain, &TestGicsClient{}, FixedClock(testNow))
+
+	assert.NoError(t, err)
+	assert.Equal(t, Accepted, ds.Status)
+	reasons := make([]string, 0)
+	for _, c := range ds.InvalidConsents {
+		reasons = append(reasons, c.Reason)
+	}
+	// consents given later are ignored
+	assert.Len(t, reasons, 3)
+	assert.Contains(t, reasons[0], "2022-13-01")
+	assert.Equal(t, "missing policy coding", reasons[1])
+	assert.Contains(t, reasons[2], "malformed Consent resource")
+}
+
+func TestPolicyStatesAtQualityControl(t *testing.T) {
+	domain := Domain{Name: "MII", CheckPolicyCode: "MDAT_erheben"}
+	permit := historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit)
+
+	cases := []struct {
+		name     string
+		entries  []fhir.BundleEntry
+		expected Status
+	}{
+		{
+			name: "newerExcluded",
+			entries: []fhir.BundleEntry{
+				{Resource: historyConsent("2022-01-01T10:00:00Z", permit)},
+				{Resource: qcConsent("invalid", "2023-01-01T10:00:00Z", permit)},
+			},
+			expected: Accepted,
+		},
+		{
+			name: "onlyExcluded",
+			entries: []fhir.BundleEntry{
+				{Resource: qcConsent("invalid", "2023-01-01T10:00:00Z", permit)},
+			},
+			expected: Invalid,
+		},
+		{
+			name: "newerValid",
+			entries: []fhir.BundleEntry{
+				{Resource: qcConsent("invalid", "2022-01-01T10:00:00Z", permit)},
+				{Resource: historyConsent("2023-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypeDeny))},
+			},
+			expected: Declined,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := &fhir.Bundle{Entry: c.entries}
+
+			ds, err := ParseConsent(policyStatesAt(b, testNow, domain.AcceptedQcStates), domain, &TestGicsClient{}, FixedClock(testNow))
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, ds.Status)
+		})
+	}
+}
+
+func historyConsent(date string, provisions ...fhir.ConsentProvision) []byte {
+	r, _ := fhir.Consent{
+		DateTime:  of(date),
+		Provision: &fhir.ConsentProvision{Provision: provisions},
+	}.MarshalJSON()
+	return r
+}
+
+func historyProvision(code string, t fhir.ConsentProvisionType) fhir.ConsentProvision {
+	return fhir.ConsentProvision{
+		Type: of(t),
+		Code: []fhir.CodeableConcept{{Coding: []fhir.Coding{{Code: of(code)}}}},
+	}
+}
+
+func TestParseHistory(t *testing.T) {
+
+	// TestGicsClient returns the source reference as template
+	domain := Domain{
+		Name:            "MII",
+		CheckPolicyCode: "MDAT_erheben",
+		WithdrawalUri:   "QuestionnaireResponse/w",
+	}
+	b := &fhir.Bundle{Entry: []fhir.BundleEntry{
+		{Resource: historyConsent("2024-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit))},
+		{Resource: historyConsentFrom("QuestionnaireResponse/w", "2025-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypeDeny))},
+		{Resource: historyConsent("2020-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypeDeny))},
+		{Resource: historyConsent("2022-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit))},
+	}}
+
+	history, err := ParseHistory(b, domain, &TestGicsClient{}, FixedClock(testNow))
+
+	assert.NoError(t, err)
+	type event struct{ date, event, status string }
+	actual := make([]event, 0, len(history))
+	for _, e := range history {
+		actual = append(actual, event{e.Date.Format(time.DateOnly), e.Event, e.Status.String()})
+	}
+	assert.Equal(t, []event{
+		{"2020-01-01", EventDeclined, "declined"},
+		{"2022-01-01", EventSigned, "accepted"},
+		{"2024-01-01", EventRenewed, "accepted"},
+		{"2025-01-01", EventWithdrawn, "withdrawn"},
+	}, actual)
+	assert.Equal(t, "QuestionnaireResponse/w", *history[3].Template)
+}
+
+func TestParseHistoryReportsInvalidConsents(t *testing.T) {
+	domain := Domain{Name: "MII", CheckPolicyCode: "MDAT_erheben"}
+	b := &fhir.Bundle{Entry: []fhir.BundleEntry{
+		{Resource: historyConsent("invalid", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypeDeny))},
+		{Resource: historyConsent("2023-01-01T10:00:00Z")},
+		{Resource: historyConsent("2022-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit))},
+		{Resource: []byte(`{"resourceType":"Consent","status":"bogus"}`)},
+	}}
+
+	history, err := ParseHistory(b, domain, &TestGicsClient{}, FixedClock(testNow))
+
+	assert.NoError(t, err)
+	if assert.Len(t, history, 4) {
+		assert.Equal(t, EventSigned, history[0].Event)
+
+		// dated invalid consent in order, keeping the status
+		assert.Equal(t, EventInvalid, history[1].Event)
+		assert.Equal(t, "2023-01-01", history[1].Date.Format(time.DateOnly))
+		assert.Equal(t, "missing policy coding", history[1].Reason)
+		assert.Equal(t, Accepted, history[1].Status)
+
+		// undated at the end
+		assert.Equal(t, EventInvalid, history[2].Event)
+		assert.Nil(t, history[2].Date)
+		assert.NotEmpty(t, history[2].Reason)
+
+		// malformed resource
+		assert.Equal(t, EventInvalid, history[3].Event)
+		assert.Contains(t, history[3].Reason, "malformed Consent resource")
+	}
+}
+
+func historyConsentFrom(source string, date string, provisions ...fhir.ConsentProvision) []byte {
+	r, _ := fhir.Consent{
+		DateTime:        of(date),
+		SourceReference: &fhir.Reference{Reference: of(source)},
+		Provision:       &fhir.ConsentProvision{Provision: provisions},
+	}.MarshalJSON()
+	return r
+}
+
+func TestParseHistoryReportsExpiry(t *testing.T) {
+	domain := Domain{Name: "MII", CheckPolicyCode: "MDAT_erheben"}
+	limited := func(end string) fhir.ConsentProvision {
+		p := historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit)
+		p.Period = &fhir.Period{End: of(end)}
+		return p
+	}
+	b := &fhir.Bundle{Entry: []fhir.BundleEntry{
+		{Resource: historyConsent("2018-01-01T10:00:00Z", limited("2020-01-01T10:00:00Z"))},
+		{Resource: historyConsent("2021-01-01T10:00:00Z", limited("2024-01-01T10:00:00Z"))},
+	}}
+
+	history, err := ParseHistory(b, domain, &TestGicsClient{}, FixedClock(testNow))
+
+	assert.NoError(t, err)
+	type event struct{ date, event, status string }
+	actual := make([]event, 0, len(history))
+	for _, e := range history {
+		actual = append(actual, event{e.Date.Format(time.DateOnly), e.Event, e.Status.String()})
+	}
+	assert.Equal(t, []event{
+		{"2018-01-01", EventSigned, "accepted"},
+		{"2020-01-01", EventExpired, "expired"},
+		{"2021-01-01", EventRenewed, "accepted"},
+		{"2024-01-01", EventExpired, "expired"},
+	}, actual)
+}
+
+func TestParseHistoryQualityControl(t *testing.T) {
+	domain := Domain{Name: "MII", CheckPolicyCode: "MDAT_erheben"}
+	b := &fhir.Bundle{Entry: []fhir.BundleEntry{
+		{Resource: historyConsent("2020-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypeDeny))},
+		{Resource: qcConsent("invalid", "2022-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit))},
+		{Resource: qcConsent("checked_no_faults", "2023-01-01T10:00:00Z", historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit))},
+	}}
+
+	history, err := ParseHistory(b, domain, &TestGicsClient{}, FixedClock(testNow))
+
+	assert.NoError(t, err)
+	type event struct{ event, status, qc string }
+	actual := make([]event, 0, len(history))
+	for _, e := range history {
+		actual = append(actual, event{e.Event, e.Status.String(), e.QcState})
+	}
+	// the excluded consent is no renewal base
+	assert.Equal(t, []event{
+		{EventDeclined, "declined", ""},
+		{EventSigned, "declined", "invalid"},
+		{EventSigned, "accepted", "checked_no_faults"},
+	}, actual)
+}
@@ -0,0 +1,123 @@
+package consent
+
+import (
+	"consented/pkg/identity"
+	"errors"
+	"expvar"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"time"
+)
+
+var (
+	ErrTooManyRequests = errors.New("too many concurrent gICS requests")
+
+	activeRequests   = expvar.NewInt("gics_requests_active")
+	rejectedRequests = expvar.NewInt("gics_requests_rejected")
+)
+
+// LimitedClient caps the number of concurrent requests to gICS. Status
+// requests which can't be served within the queue timeout fail with
+// ErrTooManyRequests.
+type LimitedClient struct {
+	client  GicsClient
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func NewLimitedClient(c GicsClient, max int, timeout time.Duration) *LimitedClient {
+	return &LimitedClient{
+		client:  c,
+		slots:   make(chan struct{}, max),
+		timeout: timeout,
+	}
+}
+
+func (c *LimitedClient) GetDomains() ([]fhir.ResearchStudy, error) {
+	c.wait()
+	defer c.release()
+
+	return c.client.GetDomains()
+}
+
+func (c *LimitedClient) GetConsentPolicies(signerId identity.Identifier, domain Domain) (*fhir.Bundle, error) {
+	if !c.acquire() {
+		return nil, ErrTooManyRequests
+	}
+	defer c.release()
+
+	return c.client.GetConsentPolicies(signerId, domain)
+}
+
+func (c *LimitedClient) GetConsentPoliciesAt(signerId identity.Identifier, domain Domain, at time.Time) (*fhir.Bundle, error) {
+	if !c.acquire() {
+		return nil, ErrTooManyRequests
+	}
+	defer c.release()
+
+	return c.client.GetConsentPoliciesAt(signerId, domain, at)
+}
+
+func (c *LimitedClient) GetConsents(signerId identity.Identifier, domain Domain) (*fhir.Bundle, error) {
+	if !c.acquire() {
+		return nil, ErrTooManyRequests
+	}
+	defer c.release()
+
+	return c.client.GetConsents(signerId, domain)
+}
+
+func (c *LimitedClient) GetTemplate(domain string, templateType string) string {
+	c.wait()
+	defer c.release()
+
+	return c.client.GetTemplate(domain, templateType)
+}
+
+func (c *LimitedClient) GetQuestionnaires(domain string) ([]fhir.Questionnaire, error) {
+	c.wait()
+	defer c.release()
+
+	return c.client.GetQuestionnaires(domain)
+}
+
+func (c *LimitedClient) GetSourceReferenceTemplate(id string) string {
+	c.wait()
+	defer c.release()
+
+	return c.client.GetSourceReferenceTemplate(id)
+}
+
+func (c *LimitedClient) AddConsent(domain Domain, document *fhir.Bundle) error {
+	if !c.acquire() {
+		return ErrTooManyRequests
+	}
+	defer c.release()
+
+	return c.client.AddConsent(domain, document)
+}
+
+// acquire waits for a free slot until the queue timeout expires
+func (c *LimitedClient) acquire() bool {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case c.slots <- struct{}{}:
+		activeRequests.Add(1)
+		return true
+	case <-timer.C:
+		rejectedRequests.Add(1)
+		return false
+	}
+}
+
+// wait blocks until a slot is free
+func (c *LimitedClient) wait() {
+	c.slots <- struct{}{}
+	activeRequests.Add(1)
+}
+
+func (c *LimitedClient) release() {
+	<-c.slots
+	activeRequests.Add(-1)
+}
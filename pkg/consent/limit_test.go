@@ -0,0 +1,42 @@
+package consent
+
+import (
+	"consented/pkg/identity"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLimitedClient(t *testing.T) {
+	block := make(chan struct{})
+	c := NewLimitedClient(&blockingGicsClient{block: block}, 1, 10*time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		_, err := c.GetConsentPolicies(identity.Identifier{Value: "1"}, Domain{})
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// no free slot
+	_, err := c.GetConsentPolicies(identity.Identifier{Value: "2"}, Domain{})
+	assert.ErrorIs(t, err, ErrTooManyRequests)
+
+	close(block)
+	assert.NoError(t, <-done)
+
+	// slot released
+	_, err = c.GetConsentPolicies(identity.Identifier{Value: "3"}, Domain{})
+	assert.NoError(t, err)
+}
+
+type blockingGicsClient struct {
+	TestGicsClient
+	block chan struct{}
+}
+
+func (c *blockingGicsClient) GetConsentPolicies(_ identity.Identifier, _ Domain) (*fhir.Bundle, error) {
+	<-c.block
+	return &fhir.Bundle{}, nil
+}
@@ -1,9 +1,12 @@
 package consent
 
 import (
+	"consented/pkg/identity"
 	"errors"
+	"fmt"
 	"github.com/rs/zerolog/log"
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"slices"
 	"strings"
 	"time"
 )
@@ -12,87 +15,171 @@ type DomainStatus struct {
 	Domain      string     `json:"domain"`
 	Description string     `json:"description"`
 	DocumentRef *string    `json:"document-ref"`
-	Status      string     `json:"status"`
+	Status      Status     `json:"status"`
 	LastUpdated *time.Time `json:"last-updated"`
 	AskConsent  bool       `json:"ask-consent"`
-	Policies    []Policy   `json:"policies"`
+	// AskConsentReason documents the ask-consent decision
+	AskConsentReason string   `json:"ask-consent-reason,omitempty"`
+	Policies         []Policy `json:"policies"`
+	// Modules of the domain's templates with their status
+	Modules []ModuleStatus `json:"modules,omitempty"`
+	// InvalidConsents were skipped during evaluation
+	InvalidConsents []InvalidConsent `json:"invalid-consents,omitempty"`
+	// QcState is the quality control type of the latest consent containing
+	// the check policy
+	QcState string `json:"qc-state,omitempty"`
+	// SignerId is the resolved identifier gICS was queried with
+	SignerId *identity.Identifier `json:"signer-id,omitempty"`
 }
 
+// InvalidConsent is a resource, which could not be evaluated
+type InvalidConsent struct {
+	Id     *string `json:"id"`
+	Reason string  `json:"reason"`
+}
+
+// ask-consent reasons
+const (
+	ReasonNotAsked          = "not-asked"
+	ReasonExpired           = "expired"
+	ReasonRenewalDue        = "renewal-due"
+	ReasonConsented         = "consented"
+	ReasonDeclined          = "declined"
+	ReasonPartiallyAccepted = "partially-accepted"
+	ReasonReaskDeclined     = "reask-declined"
+	ReasonWithdrawn         = "withdrawn"
+	ReasonReaskWithdrawn    = "reask-withdrawn"
+	ReasonPendingValidation = "pending-validation"
+	ReasonInvalid           = "invalid"
+)
+
 type Policy struct {
 	Name   string `json:"name"`
 	Permit bool   `json:"permit"`
-	Code   string `json:"-"`
+	Code   string `json:"code"`
+	System string `json:"system"`
+	// Period of the policy's provision
+	Period ValidityPeriod `json:"period"`
+	// Expired is true, if the end of the period has passed
+	Expired bool `json:"expired"`
+	// Date of the consent
+	Date *time.Time `json:"-"`
 }
 
-func ParseConsent(b *fhir.Bundle, domain Domain, c GicsClient) (*DomainStatus, error) {
+// gICS uses 3000-01-01 in its own timezone for policies without expiry
+var noExpiryDate = time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
 
-	// fixed max date
-	noExpiryDate := time.Date(3000, 1, 1, 0, 0, 0, 0, time.Local)
+// isUnlimited is true, if the date is gICS' fixed max date, regardless of
+// the timezone it was serialized in
+func isUnlimited(t time.Time) bool {
+	return !t.Before(noExpiryDate.AddDate(0, 0, -1))
+}
+
+type ValidityPeriod struct {
+	Start *time.Time `json:"start"`
+	End   *time.Time `json:"end"`
+}
+
+// ParseConsent derives the domain status from the policy states. Expiry and
+// ask-consent are evaluated relative to the clock's time.
+func ParseConsent(b *fhir.Bundle, domain Domain, c GicsClient, clock Clock) (*DomainStatus, error) {
 
 	// status result
 	ds := DomainStatus{
-		Domain:      domain.Name,
-		Description: domain.Description,
-		DocumentRef: domain.DocumentRef,
-		LastUpdated: nil,
-		AskConsent:  true,
-		Status:      Status(NotAsked).String(),
-		Policies:    make([]Policy, 0),
+		Domain:           domain.Name,
+		Description:      domain.Description,
+		DocumentRef:      domain.DocumentRef,
+		LastUpdated:      nil,
+		AskConsent:       true,
+		AskConsentReason: ReasonNotAsked,
+		Status:           NotAsked,
+		Policies:         make([]Policy, 0),
 	}
 
+	now := clock.Now()
 	// return if bundle is empty
-	if len(b.Entry) == 0 {
+	if b == nil || len(b.Entry) == 0 {
+		ds.Modules = moduleStatus(domain.Modules, nil, now)
 		return &ds, nil
 	}
 
-	checkPolicyFound := false
+	expr, err := domain.checkPolicy()
+	if err != nil {
+		log.Error().Err(err).Str("domain", domain.Name).Msg("Unable to parse checkPolicy")
+		return nil, err
+	}
+
+	// states of all policies and whether checkPolicy was found
+	states := make(map[string]policyState)
+	found := false
+	// status of consents excluded by quality control, which contain checkPolicy
+	var qc *Status
+	// date of the latest consent containing checkPolicy
+	var qcDate *time.Time
 	// check consent resources
 	for _, e := range b.Entry {
-		r, _ := fhir.UnmarshalConsent(e.Resource)
-
-		// last updated
-		updated := parseTime(r.DateTime)
-		if ds.LastUpdated == nil || updated.After(*ds.LastUpdated) {
-			ds.LastUpdated = &updated
+		r, updated, policies, err := parseEntry(e, now.Location())
+		if err != nil {
+			log.Warn().Err(err).Str("domain", domain.Name).Msg("Skipping invalid Consent resource")
+			ds.InvalidConsents = append(ds.InvalidConsents, InvalidConsent{Id: entryId(e, r), Reason: err.Error()})
+			continue
 		}
 
-		// policy
-		p, err := parsePolicy(r.Provision)
-		if err != nil {
-			log.Error().Err(err).Msg("Unable to parse policy from Consent resource")
-			return nil, err
+		// report quality control state of the latest consent containing checkPolicy
+		state := qcState(*r)
+		containsCheck := slices.ContainsFunc(policies, func(p Policy) bool { return expr.Contains(p.Code) })
+		if containsCheck && (qcDate == nil || updated != nil && updated.After(*qcDate)) {
+			ds.QcState = state
+			qcDate = updated
 		}
-		ds.Policies = append(ds.Policies, *p)
 
-		// status policy & expiration
-		now := time.Now()
-		if p.Code == domain.CheckPolicyCode {
-			checkPolicyFound = true
-			expires := parseTime(r.Provision.Provision[0].Period.End)
+		// consents excluded by quality control are not evaluated
+		if status, valid := qcStatus(state, domain.AcceptedQcStates); !valid {
+			log.Debug().Str("domain", domain.Name).Str("qc", state).Msg("Skipping Consent resource due to quality control")
+			if containsCheck {
+				qc = preferQcStatus(qc, status)
+			}
+			continue
+		}
 
-			ds.AskConsent = expires.Before(now.AddDate(1, 0, 0))
+		// last updated
+		if updated != nil && (ds.LastUpdated == nil || updated.After(*ds.LastUpdated)) {
+			ds.LastUpdated = updated
+		}
 
-			if p.Permit {
-				ds.Status = Status(Accepted).String()
-				if expires.Before(now) {
-					// already expired
-					ds.Status = Status(Expired).String()
-				}
+		// withdrawal template is resolved once per consent
+		var withdrawal *bool
+		for _, p := range policies {
+			p.Date = updated
+			p.Expired = p.IsExpired(now)
+			ds.Policies = append(ds.Policies, p)
 
-			} else {
-				// declined
-				ds.Status = Status(Declined).String()
+			// status policy & expiration
+			s := p.state(updated)
 
-				// check withdrawn state
-				if noExpiryDate.Equal(expires) && len(domain.WithdrawalUri) > 0 && domain.WithdrawalUri == c.GetSourceReferenceTemplate(*r.SourceReference.Reference) {
-					ds.Status = Status(Withdrawn).String()
+			// check withdrawn state
+			if !p.Permit && isUnlimited(s.expires) {
+				if withdrawal == nil {
+					w := isWithdrawal(*r, domain, c)
+					withdrawal = &w
 				}
+				s.withdrawn = *withdrawal
 			}
+			states[p.Code] = s
+			found = found || expr.Contains(p.Code)
 		}
 	}
 
+	// checkPolicy only found in consents excluded by quality control
+	if !found && qc != nil {
+		ds.Status = *qc
+		ds.AskConsent, ds.AskConsentReason = askConsent(domain, ds.Status, time.Time{}, noExpiryDate, now)
+		ds.Modules = moduleStatus(domain.Modules, states, now)
+		return &ds, nil
+	}
+
 	// checkPolicy not found
-	if !checkPolicyFound {
+	if !found {
 		log.Error().
 			Str("domain", domain.Name).
 			Str("checkPolicy", domain.CheckPolicyCode).
@@ -100,32 +187,203 @@ func ParseConsent(b *fhir.Bundle, domain Domain, c GicsClient) (*DomainStatus, e
 		return nil, errors.New("checkPolicy not found for domain")
 	}
 
+	result := expr.evaluate(states, now)
+	ds.Status = result.status
+	ds.AskConsent, ds.AskConsentReason = askConsent(domain, ds.Status, result.signed, result.expires, now)
+	ds.Modules = moduleStatus(domain.Modules, states, now)
+
 	return &ds, nil
 }
 
-func parsePolicy(prov *fhir.ConsentProvision) (*Policy, error) {
-	// check for provision value(s)
-	if p := prov.Provision; len(p) > 0 && len(p[0].Code) > 0 && len(p[0].Code[0].Coding) > 0 {
-		// take first coding
-		co := p[0].Code[0].Coding[0]
-		var name string
-		if co.Display != nil && strings.TrimSpace(*co.Display) != "" {
-			name = strings.TrimSpace(*co.Display)
-		} else {
-			name = *co.Code
+// askConsent decides whether the patient should be asked for consent, based on
+// the status of the check policy and the domain's re-ask rules
+func askConsent(domain Domain, status Status, signed time.Time, expires time.Time, now time.Time) (bool, string) {
+	switch status {
+	case Expired:
+		return true, ReasonExpired
+	case Withdrawn:
+		if domain.ReaskWithdrawn {
+			return true, ReasonReaskWithdrawn
 		}
+		return false, ReasonWithdrawn
+	case Pending, Unknown:
+		return false, ReasonPendingValidation
+	case Invalid:
+		return true, ReasonInvalid
+	}
 
-		return &Policy{name, p[0].Type.Code() == fhir.ConsentProvisionTypePermit.Code(), *co.Code}, nil
+	// renewal window
+	if expires.Before(domain.AskConsentBefore.AddTo(now)) {
+		return true, ReasonRenewalDue
 	}
 
-	return nil, errors.New("missing policy coding")
+	if status == Declined || status == PartiallyAccepted {
+		// grace period after decline
+		if g := domain.ReaskDeclinedAfter; g != nil && !g.AddTo(signed).After(now) {
+			return true, ReasonReaskDeclined
+		}
+		if status == PartiallyAccepted {
+			return false, ReasonPartiallyAccepted
+		}
+		return false, ReasonDeclined
+	}
+
+	return false, ReasonConsented
 }
 
-func parseTime(dt *string) time.Time {
-	t, err := time.Parse(time.RFC3339, *dt)
+// isWithdrawal is true, if the consent was created from the domain's
+// withdrawal template
+func isWithdrawal(r fhir.Consent, domain Domain, c GicsClient) bool {
+	return len(domain.WithdrawalUri) > 0 &&
+		r.SourceReference != nil && r.SourceReference.Reference != nil &&
+		domain.WithdrawalUri == c.GetSourceReferenceTemplate(*r.SourceReference.Reference)
+}
+
+// parseEntry validates a bundle entry and parses the Consent resource, its
+// date and policy
+func parseEntry(e fhir.BundleEntry, loc *time.Location) (*fhir.Consent, *time.Time, []Policy, error) {
+	if t := resourceType(e.Resource); t != "Consent" {
+		return nil, nil, nil, fmt.Errorf("unexpected resource type: '%s'", t)
+	}
+	r, err := fhir.UnmarshalConsent(e.Resource)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("malformed Consent resource: %w", err)
+	}
+
+	date, err := parseStart(r.DateTime, loc)
+	if err != nil {
+		return &r, nil, nil, err
+	}
+	if date == nil {
+		return &r, nil, nil, errors.New("missing dateTime")
+	}
+	policies, err := parsePolicies(r.Provision, loc)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to parse time from RFC3339 string")
-		return time.Time{}
+		return &r, nil, nil, err
 	}
-	return t
+
+	return &r, date, policies, nil
+}
+
+// entryId identifies an invalid entry by resource id or full url
+func entryId(e fhir.BundleEntry, r *fhir.Consent) *string {
+	if r != nil && r.Id != nil {
+		return r.Id
+	}
+	return e.FullUrl
+}
+
+// parsePolicies returns a policy per coding of all nested provisions
+func parsePolicies(prov *fhir.ConsentProvision, loc *time.Location) ([]Policy, error) {
+	if prov == nil {
+		return nil, errors.New("missing provision")
+	}
+
+	provisions := policyProvisions(prov)
+	if len(provisions) == 0 {
+		return nil, errors.New("missing policy coding")
+	}
+
+	policies := make([]Policy, 0, len(provisions))
+	for _, p := range provisions {
+		policy, err := parsePolicy(p, loc)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, *policy)
+	}
+
+	return policies, nil
+}
+
+// policyProvisions flattens the nested provisions to one provision per
+// coding. Missing type and period are inherited from the parent provision.
+func policyProvisions(prov *fhir.ConsentProvision) []fhir.ConsentProvision {
+	result := make([]fhir.ConsentProvision, 0)
+	for _, p := range prov.Provision {
+		if p.Type == nil {
+			p.Type = prov.Type
+		}
+		if p.Period == nil {
+			p.Period = prov.Period
+		}
+
+		for _, cc := range p.Code {
+			for _, co := range cc.Coding {
+				if co.Code == nil {
+					continue
+				}
+				single := p
+				single.Code = []fhir.CodeableConcept{{Coding: []fhir.Coding{co}}}
+				single.Provision = nil
+				result = append(result, single)
+			}
+		}
+
+		result = append(result, policyProvisions(&p)...)
+	}
+
+	return result
+}
+
+// parsePolicy parses a provision with a single coding
+func parsePolicy(p fhir.ConsentProvision, loc *time.Location) (*Policy, error) {
+	if p.Type == nil {
+		return nil, errors.New("missing provision type")
+	}
+
+	co := p.Code[0].Coding[0]
+	var name string
+	if co.Display != nil && strings.TrimSpace(*co.Display) != "" {
+		name = strings.TrimSpace(*co.Display)
+	} else {
+		name = *co.Code
+	}
+
+	policy := &Policy{
+		Name:   name,
+		Permit: p.Type.Code() == fhir.ConsentProvisionTypePermit.Code(),
+		Code:   *co.Code,
+	}
+	if co.System != nil {
+		policy.System = *co.System
+	}
+	if period := p.Period; period != nil {
+		var err error
+		if policy.Period.Start, err = parseStart(period.Start, loc); err != nil {
+			return nil, err
+		}
+		if policy.Period.End, err = parseEnd(period.End, loc); err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+// state returns the policy's state for status evaluation. Without period, the
+// policy is valid from the consent date without expiry.
+func (p Policy) state(date *time.Time) policyState {
+	s := policyState{permit: p.Permit, expires: noExpiryDate}
+	if p.Period.Start != nil {
+		s.signed = *p.Period.Start
+	} else if date != nil {
+		s.signed = *date
+	}
+	if p.Period.End != nil {
+		s.expires = *p.Period.End
+	}
+	return s
+}
+
+// IsPermitted is true, if the policy is permitted and valid at the given time
+func (p Policy) IsPermitted(at time.Time) bool {
+	return p.Permit &&
+		(p.Period.Start == nil || !p.Period.Start.After(at)) &&
+		!p.IsExpired(at)
+}
+
+// IsExpired is true, if the policy's period ended at or before the given time
+func (p Policy) IsExpired(at time.Time) bool {
+	return p.Period.End != nil && !p.Period.End.After(at)
 }
@@ -13,6 +13,9 @@ type Expected struct {
 	error  error
 }
 
+// testNow is the fixed evaluation time of the tests
+var testNow = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
 type ParseConsentTestCase struct {
 	name     string
 	domain   Domain
@@ -22,9 +25,9 @@ type ParseConsentTestCase struct {
 
 func TestParseConsent(t *testing.T) {
 	// prepare dates
-	now := time.Now().UTC()
-	now = time.Date(now.Year(), now.Month(), now.Day(), now.Hour(),
-		now.Minute(), now.Second(), 0, now.Location())
+	now := testNow
+	// gICS' max date serialized in its own timezone
+	noExpiry := time.Date(3000, 1, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600))
 
 	// test cases
 	cases := []ParseConsentTestCase{
@@ -40,14 +43,87 @@ func TestParseConsent(t *testing.T) {
 			policies: getTestConsentPolicies(now),
 			expected: Expected{
 				&DomainStatus{
-					Domain:      "Test",
-					Description: "Test domain",
-					Status:      "accepted",
-					LastUpdated: &now,
-					AskConsent:  false,
+					Domain:           "Test",
+					Description:      "Test domain",
+					Status:           Accepted,
+					LastUpdated:      &now,
+					AskConsent:       false,
+					AskConsentReason: "consented",
+					Policies: []Policy{
+						testPolicy("MDAT_erheben", true, now, now, now.AddDate(5, 0, 0)),
+						testPolicy("MDAT_speichern_verarbeiten", false, now, now, now.AddDate(10, 0, 0)),
+					},
+				}, nil,
+			},
+		},
+		// check policy expires within renewal window
+		{
+			name: "askConsentBeforeExpiry",
+			domain: Domain{
+				Name:             "Test",
+				Description:      "Test domain",
+				CheckPolicyCode:  "MDAT_erheben",
+				AskConsentBefore: Period{Years: 6},
+			},
+			policies: getTestConsentPolicies(now),
+			expected: Expected{
+				&DomainStatus{
+					Domain:           "Test",
+					Description:      "Test domain",
+					Status:           Accepted,
+					LastUpdated:      &now,
+					AskConsent:       true,
+					AskConsentReason: "renewal-due",
+					Policies: []Policy{
+						testPolicy("MDAT_erheben", true, now, now, now.AddDate(5, 0, 0)),
+						testPolicy("MDAT_speichern_verarbeiten", false, now, now, now.AddDate(10, 0, 0)),
+					},
+				}, nil,
+			},
+		},
+		// multiple check policies
+		{
+			name: "partiallyAcceptedCheckPolicies",
+			domain: Domain{
+				Name:            "Test",
+				Description:     "Test domain",
+				CheckPolicyCode: "MDAT_erheben&MDAT_speichern_verarbeiten",
+			},
+			policies: getTestConsentPolicies(now),
+			expected: Expected{
+				&DomainStatus{
+					Domain:           "Test",
+					Description:      "Test domain",
+					Status:           PartiallyAccepted,
+					LastUpdated:      &now,
+					AskConsent:       false,
+					AskConsentReason: "partially-accepted",
 					Policies: []Policy{
-						{"MDAT_erheben", true, "MDAT_erheben"},
-						{"MDAT_speichern_verarbeiten", false, "MDAT_speichern_verarbeiten"},
+						testPolicy("MDAT_erheben", true, now, now, now.AddDate(5, 0, 0)),
+						testPolicy("MDAT_speichern_verarbeiten", false, now, now, now.AddDate(10, 0, 0)),
+					},
+				}, nil,
+			},
+		},
+		{
+			name: "acceptedAlternativeCheckPolicies",
+			domain: Domain{
+				Name:            "Test",
+				Description:     "Test domain",
+				CheckPolicyCode: "MDAT_speichern_verarbeiten|MDAT_erheben",
+			},
+			policies: getTestConsentPolicies(now),
+			expected: Expected{
+				&DomainStatus{
+					Domain:           "Test",
+					Description:      "Test domain",
+					Status:           Accepted,
+					LastUpdated:      &now,
+					AskConsent:       false,
+					AskConsentReason: "consented",
+					Policies: []Policy{
+						testPolicy("MDAT_erheben", true, now, now, now.AddDate(5, 0, 0)),
+						testPolicy("MDAT_speichern_verarbeiten", false, now, now, now.AddDate(10, 0, 0)),
 					},
 				}, nil,
 			},
@@ -63,14 +139,15 @@ func TestParseConsent(t *testing.T) {
 			policies: getTestConsentPolicies(now),
 			expected: Expected{
 				&DomainStatus{
-					Domain:      "Test",
-					Description: "Test domain",
-					Status:      "declined",
-					LastUpdated: &now,
-					AskConsent:  false,
+					Domain:           "Test",
+					Description:      "Test domain",
+					Status:           Declined,
+					LastUpdated:      &now,
+					AskConsent:       false,
+					AskConsentReason: "declined",
 					Policies: []Policy{
-						{"MDAT_erheben", true, "MDAT_erheben"},
-						{"MDAT_speichern_verarbeiten", false, "MDAT_speichern_verarbeiten"},
+						testPolicy("MDAT_erheben", true, now, now, now.AddDate(5, 0, 0)),
+						testPolicy("MDAT_speichern_verarbeiten", false, now, now, now.AddDate(10, 0, 0)),
 					},
 				}, nil,
 			},
@@ -92,7 +169,7 @@ func TestParseConsent(t *testing.T) {
 							Type: of(fhir.ConsentProvisionTypeDeny),
 							Period: &fhir.Period{
 								Start: of(now.Format(time.RFC3339)),
-								End:   of(time.Date(3000, 1, 1, 0, 0, 0, 0, time.Local).Format(time.RFC3339)),
+								End:   of(noExpiry.Format(time.RFC3339)),
 							},
 							Code: []fhir.CodeableConcept{{
 								Coding: []fhir.Coding{{
@@ -106,13 +183,14 @@ func TestParseConsent(t *testing.T) {
 				}},
 			expected: Expected{
 				&DomainStatus{
-					Domain:      "Test",
-					Description: "Test domain",
-					Status:      "withdrawn",
-					LastUpdated: &now,
-					AskConsent:  false,
+					Domain:           "Test",
+					Description:      "Test domain",
+					Status:           Withdrawn,
+					LastUpdated:      &now,
+					AskConsent:       false,
+					AskConsentReason: "withdrawn",
 					Policies: []Policy{
-						{"MDAT_erheben", false, "MDAT_erheben"},
+						testPolicy("MDAT_erheben", false, now, now, noExpiry),
 					},
 				}, nil,
 			},
@@ -146,13 +224,14 @@ func TestParseConsent(t *testing.T) {
 				}},
 			expected: Expected{
 				&DomainStatus{
-					Domain:      "Test",
-					Description: "Test domain",
-					Status:      "expired",
-					LastUpdated: &now,
-					AskConsent:  true,
+					Domain:           "Test",
+					Description:      "Test domain",
+					Status:           Expired,
+					LastUpdated:      &now,
+					AskConsent:       true,
+					AskConsentReason: "expired",
 					Policies: []Policy{
-						{"MDAT_erheben", true, "MDAT_erheben"},
+						testPolicy("MDAT_erheben", true, now, now.AddDate(-10, 0, 0), now.AddDate(-5, 0, 0)),
 					},
 				}, nil,
 			},
@@ -169,12 +248,13 @@ func TestParseConsent(t *testing.T) {
 			policies: []fhir.Consent{},
 			expected: Expected{
 				&DomainStatus{
-					Domain:      "Test",
-					Description: "Test domain",
-					Status:      "not-asked",
-					LastUpdated: nil,
-					AskConsent:  true,
-					Policies:    []Policy{},
+					Domain:           "Test",
+					Description:      "Test domain",
+					Status:           NotAsked,
+					LastUpdated:      nil,
+					AskConsent:       true,
+					AskConsentReason: "not-asked",
+					Policies:         []Policy{},
 				}, nil,
 			},
 		},
@@ -205,7 +285,7 @@ func TestParseConsent(t *testing.T) {
 			policies: invalidate(getTestConsentPolicies(now)),
 			expected: Expected{
 				nil,
-				errors.New("missing policy coding"),
+				errors.New("checkPolicy not found for domain"),
 			},
 		},
 	}
@@ -277,12 +357,113 @@ func parseConsentHandler(t *testing.T, c ParseConsentTestCase) {
 	bundle := &fhir.Bundle{Entry: entries}
 
 	// act
-	res, err := ParseConsent(bundle, c.domain, &TestGicsClient{})
+	res, err := ParseConsent(bundle, c.domain, &TestGicsClient{}, FixedClock(testNow))
 
 	assert.Equal(t, c.expected.result, res)
 	assert.Equal(t, c.expected.error, err)
 }
 
+func TestAskConsent(t *testing.T) {
+	now := testNow
+	signed := now.AddDate(-3, 0, 0)
+	later := now.AddDate(5, 0, 0)
+	noExpiry := noExpiryDate
+
+	cases := []struct {
+		name     string
+		domain   Domain
+		status   Status
+		expires  time.Time
+		ask      bool
+		expected string
+	}{
+		{"consented", Domain{AskConsentBefore: Period{Years: 1}}, Accepted, later, false, ReasonConsented},
+		{"renewalDue", Domain{AskConsentBefore: Period{Years: 6}}, Accepted, later, true, ReasonRenewalDue},
+		{"expired", Domain{}, Expired, now.AddDate(-1, 0, 0), true, ReasonExpired},
+		{"declined", Domain{}, Declined, later, false, ReasonDeclined},
+		{"declinedGracePeriodElapsed", Domain{ReaskDeclinedAfter: &Period{Years: 2}}, Declined, later, true, ReasonReaskDeclined},
+		{"declinedWithinGracePeriod", Domain{ReaskDeclinedAfter: &Period{Years: 4}}, Declined, later, false, ReasonDeclined},
+		{"withdrawn", Domain{ReaskDeclinedAfter: &Period{Years: 2}}, Withdrawn, noExpiry, false, ReasonWithdrawn},
+		{"reaskWithdrawn", Domain{ReaskWithdrawn: true}, Withdrawn, noExpiry, true, ReasonReaskWithdrawn},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ask, reason := askConsent(c.domain, c.status, signed, c.expires, now)
+
+			assert.Equal(t, c.ask, ask)
+			assert.Equal(t, c.expected, reason)
+		})
+	}
+}
+
+func TestParseConsentBoundaries(t *testing.T) {
+
+	cases := []struct {
+		name             string
+		askConsentBefore Period
+		end              time.Time
+		status           string
+		ask              bool
+		reason           string
+	}{
+		{"expiresBeforeNow", Period{}, testNow.Add(-time.Second), "expired", true, ReasonExpired},
+		{"expiresExactlyAtNow", Period{}, testNow, "expired", true, ReasonExpired},
+		{"expiresAfterNow", Period{}, testNow.Add(time.Second), "accepted", false, ReasonConsented},
+		{"expiresWithinRenewalWindow", Period{Years: 1}, testNow.AddDate(1, 0, 0).Add(-time.Second), "accepted", true, ReasonRenewalDue},
+		{"expiresExactlyAtRenewalWindow", Period{Years: 1}, testNow.AddDate(1, 0, 0), "accepted", false, ReasonConsented},
+		{"expiresAfterRenewalWindow", Period{Years: 1}, testNow.AddDate(1, 0, 0).Add(time.Second), "accepted", false, ReasonConsented},
+		{"expiresInOtherTimezone", Period{}, testNow.In(time.FixedZone("CEST", 7200)), "expired", true, ReasonExpired},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, _ := fhir.Consent{
+				DateTime: of(testNow.AddDate(-1, 0, 0).Format(time.RFC3339)),
+				Provision: of(fhir.ConsentProvision{
+					Provision: []fhir.ConsentProvision{{
+						Type: of(fhir.ConsentProvisionTypePermit),
+						Period: &fhir.Period{
+							Start: of(testNow.AddDate(-1, 0, 0).Format(time.RFC3339)),
+							End:   of(c.end.Format(time.RFC3339)),
+						},
+						Code: []fhir.CodeableConcept{{Coding: []fhir.Coding{{Code: of("MDAT_erheben")}}}},
+					}},
+				}),
+			}.MarshalJSON()
+			domain := Domain{Name: "Test", CheckPolicyCode: "MDAT_erheben", AskConsentBefore: c.askConsentBefore}
+
+			res, err := ParseConsent(&fhir.Bundle{Entry: []fhir.BundleEntry{{Resource: r}}}, domain, &TestGicsClient{}, FixedClock(testNow))
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.status, res.Status.String())
+			assert.Equal(t, c.ask, res.AskConsent)
+			assert.Equal(t, c.reason, res.AskConsentReason)
+		})
+	}
+}
+
+func TestIsUnlimited(t *testing.T) {
+
+	cases := []struct {
+		name     string
+		date     time.Time
+		expected bool
+	}{
+		{"utc", time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"cet", time.Date(3000, 1, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600)), true},
+		{"farEast", time.Date(3000, 1, 1, 0, 0, 0, 0, time.FixedZone("LINT", 14*3600)), true},
+		{"farWest", time.Date(3000, 1, 1, 0, 0, 0, 0, time.FixedZone("AoE", -12*3600)), true},
+		{"limited", time.Date(2053, 9, 21, 0, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, isUnlimited(c.date))
+		})
+	}
+}
+
 type ParsePolicyTestCase struct {
 	name     string
 	code     string
@@ -340,42 +521,278 @@ func TestParsePolicy(t *testing.T) {
 				}},
 			}
 
-			actual, err := parsePolicy(&p)
+			actual, err := parsePolicies(&p, time.UTC)
+
+			expected := testPolicy(c.expected.Code, c.expected.Permit, now, now, now.AddDate(5, 0, 0))
+			expected.Name = c.expected.Name
+			expected.System = ""
+			expected.Expired = false
+			expected.Date = nil
 
 			assert.Nil(t, err)
-			assert.Equal(t, c.expected, *actual)
+			assert.Equal(t, []Policy{expected}, actual)
 		})
 	}
 }
 
-func TestParseTime(t *testing.T) {
+func TestParsePolicies(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)
+	coding := func(codes ...string) []fhir.CodeableConcept {
+		cc := fhir.CodeableConcept{}
+		for _, c := range codes {
+			cc.Coding = append(cc.Coding, fhir.Coding{Code: of(c)})
+		}
+		return []fhir.CodeableConcept{cc}
+	}
+
+	prov := &fhir.ConsentProvision{
+		Type:   of(fhir.ConsentProvisionTypeDeny),
+		Period: &fhir.Period{Start: of(start.Format(time.RFC3339))},
+		Provision: []fhir.ConsentProvision{
+			// multiple codings
+			{
+				Type:   of(fhir.ConsentProvisionTypePermit),
+				Period: &fhir.Period{Start: of(start.Format(time.RFC3339)), End: of(end.Format(time.RFC3339))},
+				Code:   coding("IDAT_erheben", "2.16.840.1.113883.3.1937.777.24.5.3.1"),
+			},
+			// inherits type and period
+			{
+				Code: coding("MDAT_erheben"),
+				Provision: []fhir.ConsentProvision{
+					// nested
+					{Type: of(fhir.ConsentProvisionTypePermit), Code: coding("MDAT_speichern_verarbeiten")},
+				},
+			},
+			// without coding
+			{Type: of(fhir.ConsentProvisionTypePermit)},
+		},
+	}
+
+	actual, err := parsePolicies(prov, time.UTC)
+
+	assert.NoError(t, err)
+	expected := []Policy{
+		{Name: "IDAT_erheben", Permit: true, Code: "IDAT_erheben", Period: ValidityPeriod{&start, &end}},
+		{Name: "2.16.840.1.113883.3.1937.777.24.5.3.1", Permit: true, Code: "2.16.840.1.113883.3.1937.777.24.5.3.1", Period: ValidityPeriod{&start, &end}},
+		{Name: "MDAT_erheben", Permit: false, Code: "MDAT_erheben", Period: ValidityPeriod{Start: &start}},
+		{Name: "MDAT_speichern_verarbeiten", Permit: true, Code: "MDAT_speichern_verarbeiten", Period: ValidityPeriod{Start: &start}},
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestParseDateTime(t *testing.T) {
 	loc, _ := time.LoadLocation("Europe/Berlin")
 
+	cases := []struct {
+		name  string
+		date  *string
+		start *time.Time
+		end   *time.Time
+		error bool
+	}{
+		{"dateTime", of("2023-12-21T12:42:00+01:00"), of(time.Date(2023, 12, 21, 12, 42, 0, 0, loc)), of(time.Date(2023, 12, 21, 12, 42, 0, 0, loc)), false},
+		{"instant", of("2023-12-21T11:42:00.123Z"), of(time.Date(2023, 12, 21, 12, 42, 0, 123000000, loc)), of(time.Date(2023, 12, 21, 12, 42, 0, 123000000, loc)), false},
+		{"dateTimeWithoutTimezone", of("2023-12-21T12:42:00"), of(time.Date(2023, 12, 21, 12, 42, 0, 0, loc)), of(time.Date(2023, 12, 21, 12, 42, 0, 0, loc)), false},
+		{"date", of("2023-12-21"), of(time.Date(2023, 12, 21, 0, 0, 0, 0, loc)), of(time.Date(2023, 12, 22, 0, 0, 0, 0, loc)), false},
+		{"yearMonth", of("2023-12"), of(time.Date(2023, 12, 1, 0, 0, 0, 0, loc)), of(time.Date(2024, 1, 1, 0, 0, 0, 0, loc)), false},
+		{"year", of("2023"), of(time.Date(2023, 1, 1, 0, 0, 0, 0, loc)), of(time.Date(2024, 1, 1, 0, 0, 0, 0, loc)), false},
+		{"missing", nil, nil, nil, false},
+		{"invalid", of("invalid-date-string"), nil, nil, true},
+		{"invalidMonth", of("2023-13-01"), nil, nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start, err := parseStart(c.date, loc)
+			assert.Equal(t, c.error, err != nil)
+			end, err := parseEnd(c.date, loc)
+			assert.Equal(t, c.error, err != nil)
+
+			for _, v := range []struct{ expected, actual *time.Time }{{c.start, start}, {c.end, end}} {
+				if v.expected == nil {
+					assert.Nil(t, v.actual)
+				} else {
+					assert.WithinDuration(t, *v.expected, *v.actual, 0)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConsentInvalidResources(t *testing.T) {
+	valid, _ := fhir.Consent{
+		DateTime: of(testNow.Format(time.RFC3339)),
+		Provision: of(fhir.ConsentProvision{
+			Provision: []fhir.ConsentProvision{{
+				Type: of(fhir.ConsentProvisionTypePermit),
+				Code: []fhir.CodeableConcept{{Coding: []fhir.Coding{{Code: of("MDAT_erheben")}}}},
+			}},
+		}),
+	}.MarshalJSON()
+	invalid := func(dateTime string, prov *fhir.ConsentProvision) []byte {
+		r, _ := fhir.Consent{Id: of("invalid"), DateTime: of(dateTime), Provision: prov}.MarshalJSON()
+		return r
+	}
+	withProvision := func(p fhir.ConsentProvision) *fhir.ConsentProvision {
+		return &fhir.ConsentProvision{Provision: []fhir.ConsentProvision{p}}
+	}
+	coding := []fhir.CodeableConcept{{Coding: []fhir.Coding{{Code: of("MDAT_erheben")}}}}
+	patient, _ := fhir.Patient{Id: of("invalid")}.MarshalJSON()
+
 	cases := []struct {
 		name     string
-		date     string
-		expected time.Time
+		resource []byte
+		id       *string
+		reason   string
 	}{
-		{
-			"isValidDate",
-			"2023-12-21T12:42:00+01:00",
-			time.Date(2023, 12, 21, 12, 42, 0, 0, loc),
-		},
-		{
-			"isInvalidDate",
-			"invalid-date-string",
-			time.Time{},
-		},
+		{"invalidDate", invalid("21.09.2023", withProvision(fhir.ConsentProvision{Type: of(fhir.ConsentProvisionTypePermit), Code: coding})), of("invalid"), "invalid FHIR dateTime: '21.09.2023'"},
+		{"invalidPeriod", invalid("2023-09-21", withProvision(fhir.ConsentProvision{Type: of(fhir.ConsentProvisionTypePermit), Code: coding, Period: &fhir.Period{End: of("soon")}})), of("invalid"), "invalid FHIR dateTime: 'soon'"},
+		{"missingProvision", invalid("2023-09-21", nil), of("invalid"), "missing provision"},
+		{"missingType", invalid("2023-09-21", withProvision(fhir.ConsentProvision{Code: coding})), of("invalid"), "missing provision type"},
+		{"missingCode", invalid("2023-09-21", withProvision(fhir.ConsentProvision{Type: of(fhir.ConsentProvisionTypePermit), Code: []fhir.CodeableConcept{{Coding: []fhir.Coding{{}}}}})), of("invalid"), "missing policy coding"},
+		{"unexpectedResource", patient, nil, "unexpected resource type: 'Patient'"},
+		{"malformed", []byte(`{"resourceType":"Consent","provision":{"type":"maybe"}}`), nil, "malformed Consent resource: unknown ConsentProvisionType code `maybe`"},
+		{"noJson", []byte(`<Consent/>`), nil, "unexpected resource type: ''"},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			assert.WithinDuration(t, c.expected, parseTime(&c.date), 0)
+			b := &fhir.Bundle{Entry: []fhir.BundleEntry{{Resource: valid}, {Resource: c.resource}}}
+			domain := Domain{Name: "Test", CheckPolicyCode: "MDAT_erheben"}
+
+			res, err := ParseConsent(b, domain, &TestGicsClient{}, FixedClock(testNow))
+
+			assert.NoError(t, err)
+			assert.Equal(t, Accepted, res.Status)
+			assert.Equal(t, []InvalidConsent{{Id: c.id, Reason: c.reason}}, res.InvalidConsents)
 		})
 	}
+}
+
+func TestParseConsentMultipleProvisions(t *testing.T) {
+	provision := func(code string, end time.Time) fhir.ConsentProvision {
+		return fhir.ConsentProvision{
+			Type:   of(fhir.ConsentProvisionTypePermit),
+			Period: &fhir.Period{Start: of(testNow.AddDate(-1, 0, 0).Format(time.RFC3339)), End: of(end.Format(time.RFC3339))},
+			Code:   []fhir.CodeableConcept{{Coding: []fhir.Coding{{Code: of(code)}}}},
+		}
+	}
+	// one consent with a provision per policy
+	r, _ := fhir.Consent{
+		DateTime: of(testNow.AddDate(-1, 0, 0).Format(time.RFC3339)),
+		Provision: of(fhir.ConsentProvision{
+			Provision: []fhir.ConsentProvision{
+				provision("IDAT_erheben", testNow.AddDate(4, 0, 0)),
+				provision("MDAT_erheben", testNow.AddDate(-1, 0, 0).AddDate(0, 0, 1)),
+				provision("Broad_Consent", testNow.AddDate(29, 0, 0)),
+			},
+		}),
+	}.MarshalJSON()
+	b := &fhir.Bundle{Entry: []fhir.BundleEntry{{Resource: r}}}
+
+	cases := []struct {
+		name        string
+		checkPolicy string
+		status      string
+	}{
+		{"first", "IDAT_erheben", "accepted"},
+		{"notFirst", "Broad_Consent", "accepted"},
+		{"expiredProvision", "MDAT_erheben", "expired"},
+		{"combined", "IDAT_erheben&MDAT_erheben", "expired"},
+	}
 
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			domain := Domain{Name: "Test", CheckPolicyCode: c.checkPolicy}
+
+			res, err := ParseConsent(b, domain, &TestGicsClient{}, FixedClock(testNow))
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.status, res.Status.String())
+			assert.Len(t, res.Policies, 3)
+		})
+	}
+}
+
+func TestParseConsentPartialDates(t *testing.T) {
+	r, _ := fhir.Consent{
+		DateTime: of("2023-09-21"),
+		Provision: of(fhir.ConsentProvision{
+			Provision: []fhir.ConsentProvision{{
+				Type: of(fhir.ConsentProvisionTypePermit),
+				// valid until the end of May 2024
+				Period: &fhir.Period{End: of("2024-05")},
+				Code:   []fhir.CodeableConcept{{Coding: []fhir.Coding{{Code: of("MDAT_erheben")}}}},
+			}},
+		}),
+	}.MarshalJSON()
+	domain := Domain{Name: "Test", CheckPolicyCode: "MDAT_erheben"}
+
+	res, err := ParseConsent(&fhir.Bundle{Entry: []fhir.BundleEntry{{Resource: r}}}, domain, &TestGicsClient{}, FixedClock(testNow))
+
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 9, 21, 0, 0, 0, 0, time.UTC), *res.LastUpdated)
+	assert.Nil(t, res.Policies[0].Period.Start)
+	assert.Equal(t, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), *res.Policies[0].Period.End)
+	// testNow is June 1st 2024
+	assert.Equal(t, Expired, res.Status)
+}
+
+// testPolicy creates the expected policy with times as parsed from RFC 3339
+func testPolicy(code string, permit bool, date, start, end time.Time) Policy {
+	parse := func(t time.Time) *time.Time {
+		p, _ := parseStart(of(t.Format(time.RFC3339)), time.UTC)
+		return p
+	}
+
+	return Policy{
+		Name:    code,
+		Permit:  permit,
+		Code:    code,
+		System:  "https://ths-greifswald.de/fhir/CodeSystem/gics/Policy/MII",
+		Period:  ValidityPeriod{parse(start), parse(end)},
+		Expired: !end.After(testNow),
+		Date:    parse(date),
+	}
 }
 
 func of[E any](e E) *E {
 	return &e
 }
+
+func FuzzParseConsent(f *testing.F) {
+	// seed with valid bundles and consents
+	for _, policies := range [][]fhir.Consent{getTestConsentPolicies(testNow), invalidate(getTestConsentPolicies(testNow))} {
+		entries := make([]fhir.BundleEntry, 0)
+		for _, p := range policies {
+			r, _ := p.MarshalJSON()
+			entries = append(entries, fhir.BundleEntry{Resource: r})
+			f.Add(r)
+		}
+		b, _ := fhir.Bundle{Entry: entries}.MarshalJSON()
+		f.Add(b)
+	}
+	f.Add([]byte(`{"resourceType":"Bundle","entry":[{"resource":{"resourceType":"Consent","provision":{"provision":[{}]}}}]}`))
+	f.Add([]byte(`{"resourceType":"Bundle","entry":[{"resource":{"resourceType":"Bundle","entry":[{"resource":null}]}}]}`))
+
+	domain := Domain{
+		Name:             "Test",
+		CheckPolicyCode:  "IDAT_erheben&MDAT_erheben|MDAT_speichern_verarbeiten",
+		WithdrawalUri:    "WithdrawalTemplateUri",
+		AskConsentBefore: Period{Years: 1},
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		b, err := fhir.UnmarshalBundle(data)
+		if err != nil {
+			// single resource
+			b = fhir.Bundle{Entry: []fhir.BundleEntry{{Resource: data}}}
+		}
+
+		// must not panic
+		_, _ = ParseConsent(&b, domain, &TestGicsClient{}, FixedClock(testNow))
+		_, _ = ParseHistory(&b, domain, &TestGicsClient{}, FixedClock(testNow))
+		_ = policyStatesAt(&b, testNow, nil)
+	})
+}
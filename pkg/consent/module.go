@@ -0,0 +1,116 @@
+package consent
+
+import (
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Module groups the policies of a consent template, e.g. 'Patientendaten
+// erheben' or 'Rekontaktierung'
+type Module struct {
+	Name     string
+	Policies []string
+}
+
+// ModuleStatus is the status of a module derived from its policies
+type ModuleStatus struct {
+	Name     string   `json:"name"`
+	Status   Status   `json:"status"`
+	Policies []string `json:"policies"`
+}
+
+// parseModules resolves the modules from the items of the domain's consent
+// templates. Each item with codes is a module, its codes are the policies.
+// Withdrawal templates are ignored.
+func parseModules(qs []fhir.Questionnaire) []Module {
+	var modules []Module
+	for _, q := range qs {
+		if isWithdrawalTemplate(q) {
+			continue
+		}
+		modules = appendModules(modules, q.Item)
+	}
+
+	return modules
+}
+
+func appendModules(modules []Module, items []fhir.QuestionnaireItem) []Module {
+	for _, item := range items {
+		var codes []string
+		for _, co := range item.Code {
+			if co.Code != nil && !slices.Contains(codes, *co.Code) {
+				codes = append(codes, *co.Code)
+			}
+		}
+
+		if len(codes) > 0 {
+			name := item.LinkId
+			if item.Text != nil && strings.TrimSpace(*item.Text) != "" {
+				name = strings.TrimSpace(*item.Text)
+			}
+			modules = mergeModule(modules, Module{Name: name, Policies: codes})
+		}
+
+		modules = appendModules(modules, item.Item)
+	}
+
+	return modules
+}
+
+// mergeModule adds the module or its policies, if a module with the same name
+// exists in another template
+func mergeModule(modules []Module, m Module) []Module {
+	i := slices.IndexFunc(modules, func(e Module) bool { return e.Name == m.Name })
+	if i < 0 {
+		return append(modules, m)
+	}
+
+	for _, p := range m.Policies {
+		if !slices.Contains(modules[i].Policies, p) {
+			modules[i].Policies = append(modules[i].Policies, p)
+		}
+	}
+	return modules
+}
+
+func isWithdrawalTemplate(q fhir.Questionnaire) bool {
+	for _, co := range q.Code {
+		if co.System != nil && *co.System == TemplateType && co.Code != nil && *co.Code == "WITHDRAWAL" {
+			return true
+		}
+	}
+	return false
+}
+
+// withdrawalUri returns the uri of the first withdrawal template, i.e. the last
+// segment of its url
+func withdrawalUri(qs []fhir.Questionnaire) string {
+	for _, q := range qs {
+		if isWithdrawalTemplate(q) && q.Url != nil {
+			return path.Base(*q.Url)
+		}
+	}
+	return ""
+}
+
+// moduleStatus evaluates each module like a check policy, which requires all
+// of its policies
+func moduleStatus(modules []Module, states map[string]policyState, now time.Time) []ModuleStatus {
+	if len(modules) == 0 {
+		return nil
+	}
+
+	result := make([]ModuleStatus, 0, len(modules))
+	for _, m := range modules {
+		result = append(result, ModuleStatus{
+			Name:     m.Name,
+			Status:   evaluateTerm(m.Policies, states, now).status,
+			Policies: m.Policies,
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,76 @@
+package consent
+
+import (
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestModuleStatus(t *testing.T) {
+	provision := func(code string, t fhir.ConsentProvisionType, end time.Time) fhir.ConsentProvision {
+		return fhir.ConsentProvision{
+			Type:   of(t),
+			Period: &fhir.Period{Start: of(testNow.AddDate(-1, 0, 0).Format(time.RFC3339)), End: of(end.Format(time.RFC3339))},
+			Code:   []fhir.CodeableConcept{{Coding: []fhir.Coding{{Code: of(code)}}}},
+		}
+	}
+	later := testNow.AddDate(4, 0, 0)
+	r, _ := fhir.Consent{
+		DateTime: of(testNow.AddDate(-1, 0, 0).Format(time.RFC3339)),
+		Provision: of(fhir.ConsentProvision{
+			Provision: []fhir.ConsentProvision{
+				provision("IDAT_erheben", fhir.ConsentProvisionTypePermit, later),
+				provision("MDAT_erheben", fhir.ConsentProvisionTypePermit, later),
+				provision("Rekontaktierung_Ergaenzungen", fhir.ConsentProvisionTypeDeny, later),
+				provision("Rekontaktierung_Zusatzbefund", fhir.ConsentProvisionTypePermit, later),
+				provision("BIOMAT_erheben", fhir.ConsentProvisionTypePermit, testNow.AddDate(0, 0, -1)),
+			},
+		}),
+	}.MarshalJSON()
+	b := &fhir.Bundle{Entry: []fhir.BundleEntry{{Resource: r}}}
+
+	domain := Domain{
+		Name:            "Test",
+		CheckPolicyCode: "IDAT_erheben",
+		Modules: []Module{
+			{Name: "Patientendaten erheben", Policies: []string{"IDAT_erheben", "MDAT_erheben"}},
+			{Name: "Rekontaktierung", Policies: []string{"Rekontaktierung_Ergaenzungen", "Rekontaktierung_Zusatzbefund"}},
+			{Name: "Biomaterial", Policies: []string{"BIOMAT_erheben"}},
+			{Name: "Krankenkassendaten", Policies: []string{"KKDAT_retrospektiv_uebertragen"}},
+		},
+	}
+
+	res, err := ParseConsent(b, domain, &TestGicsClient{}, FixedClock(testNow))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []ModuleStatus{
+		{Name: "Patientendaten erheben", Status: Accepted, Policies: []string{"IDAT_erheben", "MDAT_erheben"}},
+		{Name: "Rekontaktierung", Status: PartiallyAccepted, Policies: []string{"Rekontaktierung_Ergaenzungen", "Rekontaktierung_Zusatzbefund"}},
+		{Name: "Biomaterial", Status: Expired, Policies: []string{"BIOMAT_erheben"}},
+		{Name: "Krankenkassendaten", Status: NotAsked, Policies: []string{"KKDAT_retrospektiv_uebertragen"}},
+	}, res.Modules)
+}
+
+func TestModuleStatusNotAsked(t *testing.T) {
+	domain := Domain{Name: "Test", CheckPolicyCode: "IDAT_erheben", Modules: []Module{{Name: "Patientendaten erheben", Policies: []string{"IDAT_erheben"}}}}
+
+	res, err := ParseConsent(&fhir.Bundle{}, domain, &TestGicsClient{}, FixedClock(testNow))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []ModuleStatus{{Name: "Patientendaten erheben", Status: NotAsked, Policies: []string{"IDAT_erheben"}}}, res.Modules)
+}
+
+func TestParseModulesMergesTemplates(t *testing.T) {
+	qs := []fhir.Questionnaire{
+		{Item: []fhir.QuestionnaireItem{{LinkId: "1", Text: of("Rekontaktierung"), Code: []fhir.Coding{{Code: of("A")}}}}},
+		{Item: []fhir.QuestionnaireItem{{LinkId: "1", Text: of("Rekontaktierung"), Code: []fhir.Coding{{Code: of("A")}, {Code: of("B")}}}}},
+		// without text
+		{Item: []fhir.QuestionnaireItem{{LinkId: "module-c", Code: []fhir.Coding{{Code: of("C")}}}}},
+	}
+
+	assert.Equal(t, []Module{
+		{Name: "Rekontaktierung", Policies: []string{"A", "B"}},
+		{Name: "module-c", Policies: []string{"C"}},
+	}, parseModules(qs))
+}
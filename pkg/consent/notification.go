@@ -0,0 +1,81 @@
+package consent
+
+import (
+	"consented/pkg/identity"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// AddConsentNotification is the gICS notification type of added consents
+const AddConsentNotification = "GICS.AddConsent"
+
+// Notification of gICS (notification service) about changed consents or
+// domains
+type Notification struct {
+	Type      string     `json:"type"`
+	ClientId  string     `json:"clientId"`
+	CreatedAt string     `json:"createdAt"`
+	Domain    string     `json:"domainName"`
+	SignerIds []SignerId `json:"signerIds"`
+	// ConsentKey identifies the consent of consent related notifications
+	ConsentKey *struct {
+		ConsentTemplateKey struct {
+			Domain string `json:"domainName"`
+		} `json:"consentTemplateKey"`
+		SignerIds []SignerId `json:"signerIds"`
+	} `json:"consentKey"`
+}
+
+// SignerId of a gICS notification, typed by the name of the signer id type
+type SignerId struct {
+	IdType string `json:"idType"`
+	Id     string `json:"id"`
+}
+
+// ParseNotification parses the JSON payload of a gICS notification. Domain
+// and signer ids of the consent key are copied to the notification.
+func ParseNotification(data []byte) (Notification, error) {
+	var n Notification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return n, fmt.Errorf("invalid gICS notification: %w", err)
+	}
+	if n.Type == "" {
+		return n, errors.New("invalid gICS notification: missing type")
+	}
+
+	if k := n.ConsentKey; k != nil {
+		if n.Domain == "" {
+			n.Domain = k.ConsentTemplateKey.Domain
+		}
+		n.SignerIds = append(n.SignerIds, k.SignerIds...)
+	}
+	return n, nil
+}
+
+// AffectsDomains is true for changes of domains, templates or policies, which
+// require updating the domain cache
+func (n Notification) AffectsDomains() bool {
+	for _, s := range []string{"Domain", "Template", "Policy"} {
+		if strings.Contains(n.Type, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignerIdentifier returns the identifier of the signer id, the system is
+// the domain's signer id system with the type's name
+func (d Domain) SignerIdentifier(s SignerId) identity.Identifier {
+	for _, system := range d.PersonIdSystems {
+		if path.Base(system) == s.IdType {
+			return identity.Identifier{System: system, Value: s.Id}
+		}
+	}
+	if path.Base(d.PersonIdSystem) == s.IdType {
+		return identity.Identifier{System: d.PersonIdSystem, Value: s.Id}
+	}
+	return identity.Identifier{Value: s.Id}
+}
@@ -0,0 +1,71 @@
+package consent
+
+import (
+	"consented/pkg/identity"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseNotification(t *testing.T) {
+	cases := []struct {
+		name      string
+		payload   string
+		domain    string
+		signerIds []SignerId
+		domains   bool
+		err       bool
+	}{
+		{
+			name:      "addConsent",
+			payload:   `{"type":"GICS.AddConsent","clientId":"gICS_Web","createdAt":"2024-06-01T12:00:00","consentKey":{"consentTemplateKey":{"domainName":"MII","name":"Patienteneinwilligung MII","version":"1.6.d"},"signerIds":[{"idType":"Patienten-ID","id":"42"}],"consentDate":"2024-06-01T12:00:00"}}`,
+			domain:    "MII",
+			signerIds: []SignerId{{IdType: "Patienten-ID", Id: "42"}},
+		},
+		{
+			name:      "topLevelSignerIds",
+			payload:   `{"type":"GICS.SetQcForConsent","domainName":"MII","signerIds":[{"idType":"Pseudonym","id":"psn"}]}`,
+			domain:    "MII",
+			signerIds: []SignerId{{IdType: "Pseudonym", Id: "psn"}},
+		},
+		{
+			name:    "updateDomain",
+			payload: `{"type":"GICS.UpdateDomain","domainName":"MII"}`,
+			domain:  "MII",
+			domains: true,
+		},
+		{
+			name:    "finaliseTemplate",
+			payload: `{"type":"GICS.FinaliseTemplate"}`,
+			domains: true,
+		},
+		{name: "missingType", payload: `{"domainName":"MII"}`, err: true},
+		{name: "invalidJson", payload: `GICS.AddConsent`, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n, err := ParseNotification([]byte(c.payload))
+
+			if c.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.domain, n.Domain)
+			assert.Equal(t, c.signerIds, n.SignerIds)
+			assert.Equal(t, c.domains, n.AffectsDomains())
+		})
+	}
+}
+
+func TestSignerIdentifier(t *testing.T) {
+	d := Domain{
+		PersonIdSystem:  "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID",
+		PersonIdSystems: []string{"https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID", "https://ths-greifswald.de/fhir/gics/identifiers/Pseudonym"},
+	}
+
+	assert.Equal(t, identity.Identifier{System: "https://ths-greifswald.de/fhir/gics/identifiers/Pseudonym", Value: "psn"}, d.SignerIdentifier(SignerId{IdType: "Pseudonym", Id: "psn"}))
+	assert.Equal(t, identity.Identifier{System: "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID", Value: "42"}, d.SignerIdentifier(SignerId{IdType: "Patienten-ID", Id: "42"}))
+	// unknown types
+	assert.Equal(t, identity.Identifier{Value: "42"}, d.SignerIdentifier(SignerId{IdType: "MPI", Id: "42"}))
+}
@@ -0,0 +1,88 @@
+package consent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var periodPattern = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// Period is an ISO 8601 duration (e.g. P1Y, P6M, P2W, P1DT12H). Calendar
+// units are kept separately, so they can be added to dates correctly.
+type Period struct {
+	Years  int
+	Months int
+	Days   int
+	Time   time.Duration
+}
+
+// ParsePeriod parses an ISO 8601 duration. Fractions and negative durations
+// are not supported.
+func ParsePeriod(s string) (Period, error) {
+	norm := strings.ToUpper(strings.TrimSpace(s))
+	m := periodPattern.FindStringSubmatch(norm)
+	if m == nil || norm == "P" || strings.HasSuffix(norm, "T") {
+		return Period{}, fmt.Errorf("invalid ISO 8601 duration: '%s'", s)
+	}
+
+	v := make([]int, len(m))
+	for i, g := range m[1:] {
+		if g != "" {
+			v[i+1], _ = strconv.Atoi(g)
+		}
+	}
+
+	return Period{
+		Years:  v[1],
+		Months: v[2],
+		Days:   v[3]*7 + v[4],
+		Time: time.Duration(v[5])*time.Hour +
+			time.Duration(v[6])*time.Minute +
+			time.Duration(v[7])*time.Second,
+	}, nil
+}
+
+// AddTo adds the period to the time
+func (p Period) AddTo(t time.Time) time.Time {
+	return t.AddDate(p.Years, p.Months, p.Days).Add(p.Time)
+}
+
+func (p Period) IsZero() bool {
+	return p == Period{}
+}
+
+func (p Period) String() string {
+	if p.IsZero() {
+		return "P0D"
+	}
+
+	var b strings.Builder
+	b.WriteString("P")
+	for _, u := range []struct {
+		v    int
+		unit string
+	}{{p.Years, "Y"}, {p.Months, "M"}, {p.Days, "D"}} {
+		if u.v != 0 {
+			b.WriteString(strconv.Itoa(u.v) + u.unit)
+		}
+	}
+	if p.Time != 0 {
+		b.WriteString("T")
+		h := int(p.Time.Hours())
+		m := int(p.Time.Minutes()) % 60
+		sec := int(p.Time.Seconds()) % 60
+		for _, u := range []struct {
+			v    int
+			unit string
+		}{{h, "H"}, {m, "M"}, {sec, "S"}} {
+			if u.v != 0 {
+				b.WriteString(strconv.Itoa(u.v) + u.unit)
+			}
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,54 @@
+package consent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParsePeriod(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected Period
+	}{
+		{"P1Y", Period{Years: 1}},
+		{"P6M", Period{Months: 6}},
+		{"P2W", Period{Days: 14}},
+		{"P1Y2M3D", Period{Years: 1, Months: 2, Days: 3}},
+		{"P1DT12H", Period{Days: 1, Time: 12 * time.Hour}},
+		{"PT90M", Period{Time: 90 * time.Minute}},
+		{"p6m", Period{Months: 6}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			actual, err := ParsePeriod(c.value)
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, actual)
+		})
+	}
+}
+
+func TestParsePeriodInvalid(t *testing.T) {
+	for _, v := range []string{"", "P", "PT", "1Y", "P1.5Y", "-P1Y", "P1H", "6 months"} {
+		t.Run(v, func(t *testing.T) {
+			_, err := ParsePeriod(v)
+
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPeriodAddTo(t *testing.T) {
+	start := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC), Period{Years: 1}.AddTo(start))
+	assert.Equal(t, time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC), Period{Months: 6, Time: 12 * time.Hour}.AddTo(start))
+}
+
+func TestPeriodString(t *testing.T) {
+	assert.Equal(t, "P0D", Period{}.String())
+	assert.Equal(t, "P1Y6M", Period{Years: 1, Months: 6}.String())
+	assert.Equal(t, "P1DT1H30M", Period{Days: 1, Time: 90 * time.Minute}.String())
+}
@@ -0,0 +1,79 @@
+package consent
+
+import (
+	"slices"
+	"time"
+)
+
+// Permission is the result of a permission check of a single policy across
+// domains
+type Permission struct {
+	Policy    string `json:"policy"`
+	Permitted bool   `json:"permitted"`
+	// Domain deciding the permission (if any)
+	Domain      *string    `json:"domain"`
+	ConsentDate *time.Time `json:"consent-date"`
+	Expires     *time.Time `json:"expires"`
+	// FailedDomains could not be evaluated, but might permit the policy
+	FailedDomains []string `json:"failed-domains,omitempty"`
+}
+
+// CheckPermission checks if the policy is permitted at the given time in any
+// of the domains. If permitted by multiple domains, the one with the latest
+// expiry decides. Otherwise, the most recent consent of the policy is
+// reported, together with the failed domains, which might contain the policy.
+func CheckPermission(code string, statuses []DomainStatus, failed []Domain, at time.Time) Permission {
+	result := Permission{Policy: code}
+
+	var decision *Policy
+	for _, ds := range statuses {
+		for _, p := range ds.Policies {
+			if p.Code != code {
+				continue
+			}
+
+			if p.IsPermitted(at) {
+				if !result.Permitted || isLater(p.Period.End, decision.Period.End) {
+					result.Permitted = true
+					result.Domain = &ds.Domain
+					decision = &p
+				}
+			} else if !result.Permitted && (decision == nil || isLater(p.Date, decision.Date)) {
+				result.Domain = &ds.Domain
+				decision = &p
+			}
+		}
+	}
+
+	if decision != nil {
+		result.ConsentDate = decision.Date
+		result.Expires = decision.Period.End
+	}
+	if !result.Permitted {
+		for _, d := range failed {
+			if d.mayContain(code) {
+				result.FailedDomains = append(result.FailedDomains, d.Name)
+			}
+		}
+	}
+
+	return result
+}
+
+// mayContain is true, if the domain's templates or checkPolicy reference the
+// policy. Without known modules, the domain may contain any policy.
+func (d Domain) mayContain(code string) bool {
+	if len(d.Modules) == 0 || slices.ContainsFunc(d.Modules, func(m Module) bool { return slices.Contains(m.Policies, code) }) {
+		return true
+	}
+	expr, err := d.checkPolicy()
+	return err != nil || expr.Contains(code)
+}
+
+// isLater compares optional times, where nil is considered to be infinite
+func isLater(t *time.Time, other *time.Time) bool {
+	if other == nil {
+		return false
+	}
+	return t == nil || t.After(*other)
+}
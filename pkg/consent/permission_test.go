@@ -0,0 +1,95 @@
+package consent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCheckPermission(t *testing.T) {
+	now := time.Now()
+	signed := now.AddDate(-1, 0, 0)
+	later := now.AddDate(5, 0, 0)
+	latest := now.AddDate(10, 0, 0)
+
+	policy := func(code string, permit bool, date time.Time, end time.Time) Policy {
+		return Policy{Name: code, Code: code, Permit: permit, Date: &date, Period: ValidityPeriod{&signed, &end}}
+	}
+
+	statuses := []DomainStatus{
+		{
+			Domain: "A",
+			Policies: []Policy{
+				policy("MDAT_erheben", true, signed, later),
+				policy("Rekontaktierung", false, signed, later),
+				policy("Biomaterial", true, signed, now.AddDate(0, 0, -1)),
+			},
+		},
+		{
+			Domain: "B",
+			Policies: []Policy{
+				policy("MDAT_erheben", true, signed, latest),
+				policy("Rekontaktierung", false, now, later),
+			},
+		},
+	}
+
+	// failed to evaluate, D's policies are known
+	failed := []Domain{
+		{Name: "C"},
+		{Name: "D", CheckPolicyCode: "IDAT_erheben", Modules: []Module{{Name: "IDAT", Policies: []string{"IDAT_speichern"}}}},
+	}
+
+	cases := []struct {
+		code     string
+		expected Permission
+	}{
+		{
+			code:     "MDAT_erheben",
+			expected: Permission{Policy: "MDAT_erheben", Permitted: true, Domain: of("B"), ConsentDate: &signed, Expires: &latest},
+		},
+		{
+			code:     "Rekontaktierung",
+			expected: Permission{Policy: "Rekontaktierung", Domain: of("B"), ConsentDate: &now, Expires: &later, FailedDomains: []string{"C"}},
+		},
+		{
+			code:     "Biomaterial",
+			expected: Permission{Policy: "Biomaterial", Domain: of("A"), ConsentDate: &signed, Expires: of(now.AddDate(0, 0, -1)), FailedDomains: []string{"C"}},
+		},
+		{
+			code:     "Unknown",
+			expected: Permission{Policy: "Unknown", FailedDomains: []string{"C"}},
+		},
+		{
+			code:     "IDAT_erheben",
+			expected: Permission{Policy: "IDAT_erheben", FailedDomains: []string{"C", "D"}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.code, func(t *testing.T) {
+			assert.Equal(t, c.expected, CheckPermission(c.code, statuses, failed, now))
+		})
+	}
+}
+
+func TestPolicyIsPermitted(t *testing.T) {
+	now := time.Now()
+	start := now.AddDate(-1, 0, 0)
+	end := now.AddDate(1, 0, 0)
+
+	assert.True(t, Policy{Permit: true, Period: ValidityPeriod{&start, &end}}.IsPermitted(now))
+	assert.True(t, Policy{Permit: true}.IsPermitted(now))
+	assert.False(t, Policy{Permit: false, Period: ValidityPeriod{&start, &end}}.IsPermitted(now))
+	assert.False(t, Policy{Permit: true, Period: ValidityPeriod{&start, &end}}.IsPermitted(end))
+	assert.False(t, Policy{Permit: true, Period: ValidityPeriod{Start: &end}}.IsPermitted(now))
+}
+
+func TestPolicyIsExpired(t *testing.T) {
+	now := time.Now()
+	end := now.AddDate(1, 0, 0)
+
+	assert.False(t, Policy{Period: ValidityPeriod{End: &end}}.IsExpired(now))
+	assert.True(t, Policy{Period: ValidityPeriod{End: &end}}.IsExpired(end))
+	assert.False(t, Policy{}.IsExpired(now))
+}
@@ -0,0 +1,73 @@
+package consent
+
+import (
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"slices"
+)
+
+const QualityControlElementSystem = "https://ths-greifswald.de/fhir/StructureDefinition/gics/QualityControl"
+
+// qcPrecedence orders the statuses of consents excluded by quality control.
+// If the check policy is only found in excluded consents, the first matching
+// status is reported.
+var qcPrecedence = []Status{Pending, Unknown, Invalid}
+
+// qcState returns the gICS quality control type of the consent or an empty
+// string, if the consent has no quality control information
+func qcState(r fhir.Consent) string {
+	for _, e := range r.Extension {
+		if e.Url != QualityControlElementSystem {
+			continue
+		}
+
+		for _, ee := range e.Extension {
+			if ee.Url != "type" {
+				continue
+			}
+			if ee.ValueString != nil {
+				return *ee.ValueString
+			}
+			if ee.ValueCoding != nil && ee.ValueCoding.Code != nil {
+				return *ee.ValueCoding.Code
+			}
+		}
+	}
+	return ""
+}
+
+// qcStatus maps the quality control state onto a status. Consents without
+// quality control information are valid. If the domain configures accepted
+// states, all other states are not valid: explicitly rejected consents are
+// invalid, unchecked ones pending and others unknown. Otherwise, consents
+// which passed quality control or were not checked are valid.
+func qcStatus(state string, accepted []string) (Status, bool) {
+	if state == "" || slices.Contains(accepted, state) {
+		return Accepted, true
+	}
+
+	switch state {
+	case "pending":
+		return Pending, false
+	case "unknown":
+		return Unknown, false
+	case "invalid", "checked_major_faults":
+		return Invalid, false
+	}
+
+	if accepted == nil {
+		return Accepted, true
+	}
+	// not (yet) accepted by the domain
+	if state == "not_checked" {
+		return Pending, false
+	}
+	return Unknown, false
+}
+
+// preferQcStatus returns the status with higher precedence
+func preferQcStatus(current *Status, s Status) *Status {
+	if current == nil || slices.Index(qcPrecedence, s) < slices.Index(qcPrecedence, *current) {
+		return &s
+	}
+	return current
+}
@@ -0,0 +1,86 @@
+package consent
+
+import (
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func qcConsent(state string, date string, provisions ...fhir.ConsentProvision) []byte {
+	r, _ := fhir.Consent{
+		Extension: []fhir.Extension{{
+			Url:       QualityControlElementSystem,
+			Extension: []fhir.Extension{{Url: "type", ValueString: of(state)}},
+		}},
+		DateTime:  of(date),
+		Provision: &fhir.ConsentProvision{Provision: provisions},
+	}.MarshalJSON()
+	return r
+}
+
+func TestParseConsentQualityControl(t *testing.T) {
+	domain := Domain{Name: "MII", CheckPolicyCode: "MDAT_erheben"}
+	strict := Domain{Name: "MII", CheckPolicyCode: "MDAT_erheben", AcceptedQcStates: []string{"checked_no_faults"}}
+	permit := historyProvision("MDAT_erheben", fhir.ConsentProvisionTypePermit)
+	deny := historyProvision("MDAT_erheben", fhir.ConsentProvisionTypeDeny)
+
+	cases := []struct {
+		name     string
+		domain   Domain
+		entries  [][]byte
+		status   Status
+		ask      bool
+		reason   string
+		policies int
+		qcState  string
+	}{
+		{"valid", domain, [][]byte{qcConsent("checked_no_faults", "2024-01-01", permit)}, Accepted, false, ReasonConsented, 1, "checked_no_faults"},
+		{"notChecked", domain, [][]byte{qcConsent("not_checked", "2024-01-01", permit)}, Accepted, false, ReasonConsented, 1, "not_checked"},
+		{"withoutQc", domain, [][]byte{historyConsent("2024-01-01", permit)}, Accepted, false, ReasonConsented, 1, ""},
+		{"pending", domain, [][]byte{qcConsent("pending", "2024-01-01", permit)}, Pending, false, ReasonPendingValidation, 0, "pending"},
+		{"unknown", domain, [][]byte{qcConsent("unknown", "2024-01-01", permit)}, Unknown, false, ReasonPendingValidation, 0, "unknown"},
+		{"invalid", domain, [][]byte{qcConsent("invalid", "2024-01-01", permit)}, Invalid, true, ReasonInvalid, 0, "invalid"},
+		{"majorFaults", domain, [][]byte{qcConsent("checked_major_faults", "2024-01-01", permit)}, Invalid, true, ReasonInvalid, 0, "checked_major_faults"},
+		{"pendingBeforeInvalid", domain, [][]byte{
+			qcConsent("invalid", "2024-01-01", permit),
+			qcConsent("pending", "2024-02-01", permit),
+		}, Pending, false, ReasonPendingValidation, 0, "pending"},
+		{"validPreferred", domain, [][]byte{
+			historyConsent("2023-01-01", deny),
+			qcConsent("pending", "2024-01-01", permit),
+		}, Declined, false, ReasonDeclined, 1, "pending"},
+		{"acceptedByDomain", strict, [][]byte{qcConsent("checked_no_faults", "2024-01-01", permit)}, Accepted, false, ReasonConsented, 1, "checked_no_faults"},
+		{"notCheckedByDomain", strict, [][]byte{qcConsent("not_checked", "2024-01-01", permit)}, Pending, false, ReasonPendingValidation, 0, "not_checked"},
+		{"notAcceptedByDomain", strict, [][]byte{qcConsent("checked_minor_faults", "2024-01-01", permit)}, Unknown, false, ReasonPendingValidation, 0, "checked_minor_faults"},
+		{"rejectedByDomain", strict, [][]byte{qcConsent("checked_major_faults", "2024-01-01", permit)}, Invalid, true, ReasonInvalid, 0, "checked_major_faults"},
+		{"pendingNotAcceptedByDomain", strict, [][]byte{qcConsent("pending", "2024-01-01", permit)}, Pending, false, ReasonPendingValidation, 0, "pending"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := &fhir.Bundle{}
+			for _, e := range c.entries {
+				b.Entry = append(b.Entry, fhir.BundleEntry{Resource: e})
+			}
+
+			res, err := ParseConsent(b, c.domain, &TestGicsClient{}, FixedClock(testNow))
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.status, res.Status)
+			assert.Equal(t, c.ask, res.AskConsent)
+			assert.Equal(t, c.reason, res.AskConsentReason)
+			assert.Len(t, res.Policies, c.policies)
+			assert.Equal(t, c.qcState, res.QcState)
+		})
+	}
+}
+
+func TestQcStateFromCoding(t *testing.T) {
+	r := fhir.Consent{Extension: []fhir.Extension{{
+		Url:       QualityControlElementSystem,
+		Extension: []fhir.Extension{{Url: "type", ValueCoding: &fhir.Coding{Code: of("pending")}}},
+	}}}
+
+	assert.Equal(t, "pending", qcState(r))
+	assert.Equal(t, "", qcState(fhir.Consent{}))
+}
@@ -1,15 +1,60 @@
 package consent
 
+import (
+	"fmt"
+	"slices"
+)
+
 type Status int
 
 const (
-	NotAsked = iota
+	NotAsked Status = iota
 	Accepted
 	Declined
 	Expired
 	Withdrawn
+	Forbidden
+	PartiallyAccepted
+	// Pending consents await validation, e.g. of the signatures
+	Pending
+	// Unknown is the status of consents with unknown quality control state
+	Unknown
+	// Invalid consents were rejected by quality control
+	Invalid
+	// Failed indicates that the status could not be evaluated
+	Failed
 )
 
+var statusNames = []string{"not-asked", "accepted", "declined", "expired", "withdrawn", "forbidden",
+	"partially-accepted", "pending", "unknown", "invalid", "failed"}
+
 func (s Status) String() string {
-	return [...]string{"not-asked", "accepted", "declined", "expired", "withdrawn"}[s]
+	if s < 0 || int(s) >= len(statusNames) {
+		return fmt.Sprintf("Status(%d)", int(s))
+	}
+	return statusNames[s]
+}
+
+// ParseStatus returns the status with the given name
+func ParseStatus(name string) (Status, error) {
+	if i := slices.Index(statusNames, name); i >= 0 {
+		return Status(i), nil
+	}
+	return NotAsked, fmt.Errorf("invalid consent status: '%s'", name)
+}
+
+func (s Status) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(statusNames) {
+		return nil, fmt.Errorf("invalid consent status: %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+func (s *Status) UnmarshalText(text []byte) error {
+	status, err := ParseStatus(string(text))
+	if err != nil {
+		return err
+	}
+	*s = status
+	return nil
 }
@@ -1,6 +1,7 @@
 package consent
 
 import (
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -10,4 +11,56 @@ func TestToString(t *testing.T) {
 	assert.Equal(t, Status(NotAsked).String(), "not-asked")
 	assert.Equal(t, Status(Accepted).String(), "accepted")
 	assert.Equal(t, Status(Expired).String(), "expired")
+	assert.Equal(t, Status(Pending).String(), "pending")
+	assert.Equal(t, Status(Failed).String(), "failed")
+	// out of range
+	assert.Equal(t, Status(42).String(), "Status(42)")
+	assert.Equal(t, Status(-1).String(), "Status(-1)")
+}
+
+func TestParseStatus(t *testing.T) {
+	for s := NotAsked; s <= Failed; s++ {
+		parsed, err := ParseStatus(s.String())
+
+		assert.NoError(t, err)
+		assert.Equal(t, s, parsed)
+	}
+
+	_, err := ParseStatus("consented")
+	assert.EqualError(t, err, "invalid consent status: 'consented'")
+}
+
+func TestStatusJson(t *testing.T) {
+	cases := []struct {
+		name     string
+		json     string
+		expected Status
+		err      bool
+	}{
+		{"accepted", `"accepted"`, Accepted, false},
+		{"invalid", `"invalid"`, Invalid, false},
+		{"unknownName", `"foo"`, NotAsked, true},
+		{"number", `1`, NotAsked, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var s Status
+			err := json.Unmarshal([]byte(c.json), &s)
+
+			if c.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, s)
+
+			b, err := json.Marshal(s)
+			assert.NoError(t, err)
+			assert.Equal(t, c.json, string(b))
+		})
+	}
+
+	_, err := json.Marshal(Status(42))
+	assert.Error(t, err)
 }
@@ -0,0 +1,86 @@
+package events
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQueueFull is returned, if the published event can't be queued
+var ErrQueueFull = errors.New("event queue full")
+
+// ErrClosed is returned for events published after closing the bus
+var ErrClosed = errors.New("event bus closed")
+
+// Handler receives the published events
+type Handler[E any] func(e E)
+
+// Bus fans out events to all subscribed handlers. Events are queued and handled
+// in the background by a fixed number of workers, so publishers are not
+// blocked. The handlers of an event are called in order of subscription.
+type Bus[E any] struct {
+	mu       sync.RWMutex
+	handlers []Handler[E]
+	queue    chan E
+	closed   bool
+	workers  sync.WaitGroup
+}
+
+// NewBus starts the workers handling the queued events. Publishing fails, if
+// the queue is full.
+func NewBus[E any](workers int, size int) *Bus[E] {
+	b := &Bus[E]{queue: make(chan E, size)}
+	for range max(workers, 1) {
+		b.workers.Add(1)
+		go func() {
+			defer b.workers.Done()
+			for e := range b.queue {
+				b.handle(e)
+			}
+		}()
+	}
+	return b
+}
+
+// Subscribe registers the handler for all subsequently handled events
+func (b *Bus[E]) Subscribe(h Handler[E]) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+// Publish queues the event for all handlers
+func (b *Bus[E]) Publish(e E) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	select {
+	case b.queue <- e:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting events and waits for the queued ones to be handled
+func (b *Bus[E]) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	b.workers.Wait()
+}
+
+func (b *Bus[E]) handle(e E) {
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
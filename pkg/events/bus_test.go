@@ -0,0 +1,63 @@
+package events
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestPublish(t *testing.T) {
+	b := NewBus[string](2, 10)
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	for _, name := range []string{"webhooks", "domains"} {
+		b.Subscribe(func(e string) {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name] = append(received[name], e)
+		})
+	}
+
+	assert.NoError(t, b.Publish("GICS.AddConsent"))
+	b.Close()
+
+	assert.Equal(t, map[string][]string{"webhooks": {"GICS.AddConsent"}, "domains": {"GICS.AddConsent"}}, received)
+}
+
+func TestPublishWithoutHandlers(t *testing.T) {
+	b := NewBus[string](1, 1)
+
+	assert.NoError(t, b.Publish("GICS.AddConsent"))
+	b.Close()
+}
+
+func TestPublishQueueFull(t *testing.T) {
+	b := NewBus[string](1, 1)
+
+	// block the worker with the first event
+	started, release := make(chan bool), make(chan bool)
+	b.Subscribe(func(e string) {
+		if e == "first" {
+			started <- true
+			<-release
+		}
+	})
+	assert.NoError(t, b.Publish("first"))
+	<-started
+
+	assert.NoError(t, b.Publish("queued"))
+	assert.ErrorIs(t, b.Publish("dropped"), ErrQueueFull)
+
+	close(release)
+	b.Close()
+}
+
+func TestPublishAfterClose(t *testing.T) {
+	b := NewBus[string](1, 1)
+	b.Close()
+
+	assert.ErrorIs(t, b.Publish("GICS.AddConsent"), ErrClosed)
+	// closing again is safe
+	b.Close()
+}
@@ -0,0 +1,53 @@
+package identity
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache keeps resolved identifiers for a fixed duration. Failed resolutions
+// are not cached.
+type Cache struct {
+	resolver Resolver
+	ttl      time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	entries  map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	id      Identifier
+	expires time.Time
+}
+
+func NewCache(r Resolver, ttl time.Duration) *Cache {
+	return &Cache{resolver: r, ttl: ttl, now: time.Now, entries: make(map[string]cacheEntry)}
+}
+
+func (c *Cache) Resolve(pid string) (*Identifier, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	e, ok := c.entries[pid]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return &e.id, nil
+	}
+
+	id, err := c.resolver.Resolve(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// remove expired entries
+	for k, v := range c.entries {
+		if !now.Before(v.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[pid] = cacheEntry{id: *id, expires: now.Add(c.ttl)}
+
+	return id, nil
+}
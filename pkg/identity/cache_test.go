@@ -0,0 +1,56 @@
+package identity
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type countingResolver struct {
+	calls int
+	err   error
+}
+
+func (r *countingResolver) Resolve(pid string) (*Identifier, error) {
+	r.calls++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &Identifier{System: "psn", Value: "psn-" + pid}, nil
+}
+
+func TestCache(t *testing.T) {
+	r := &countingResolver{}
+	c := NewCache(r, time.Hour)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	id, _ := c.Resolve("42")
+	assert.Equal(t, "psn-42", id.Value)
+	_, _ = c.Resolve("42")
+	assert.Equal(t, 1, r.calls)
+
+	// other patient
+	_, _ = c.Resolve("43")
+	assert.Equal(t, 2, r.calls)
+
+	// expired
+	now = now.Add(time.Hour)
+	_, _ = c.Resolve("42")
+	assert.Equal(t, 3, r.calls)
+}
+
+func TestCacheSkipsErrors(t *testing.T) {
+	r := &countingResolver{err: errors.New("gPAS unavailable")}
+	c := NewCache(r, time.Hour)
+
+	_, err := c.Resolve("42")
+	assert.Error(t, err)
+
+	r.err = nil
+	id, err := c.Resolve("42")
+	assert.NoError(t, err)
+	assert.Equal(t, "psn-42", id.Value)
+	assert.Equal(t, 2, r.calls)
+}
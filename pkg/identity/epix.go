@@ -0,0 +1,42 @@
+package identity
+
+import (
+	"consented/pkg/config"
+	"fmt"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"net/http"
+)
+
+// EpixResolver resolves the MPI id of the person with the patient id (a
+// local identifier in the identifier domain) via the $searchPersonByIdentifier
+// operation of the E-PIX FHIR gateway
+type EpixResolver struct {
+	Fhir             config.Fhir
+	Domain           string
+	IdentifierDomain string
+	// System of the MPI ids (empty: as returned by E-PIX)
+	System string
+	// Client of the FHIR gateway (nil: default with timeout)
+	Client *http.Client
+}
+
+func (r *EpixResolver) Resolve(pid string) (*Identifier, error) {
+	res, err := postOperation(r.Client, r.Fhir, "$searchPersonByIdentifier", fhir.Parameters{
+		Parameter: []fhir.ParametersParameter{
+			{Name: "domain", ValueString: of(r.Domain)},
+			{Name: "identifier", ValueString: of(pid)},
+			{Name: "identifierDomain", ValueString: of(r.IdentifierDomain)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range res.Parameter {
+		if p.Name == "mpiId" {
+			return toIdentifier(p.ValueIdentifier, r.System)
+		}
+	}
+
+	return nil, fmt.Errorf("no MPI id found in E-PIX domain '%s'", r.Domain)
+}
@@ -0,0 +1,37 @@
+package identity
+
+import (
+	"consented/pkg/config"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestEpixResolve(t *testing.T) {
+	res := fhir.Parameters{Parameter: []fhir.ParametersParameter{
+		{Name: "mpiId", ValueIdentifier: &fhir.Identifier{System: of("https://ths-greifswald.de/epix/MPI"), Value: of("1001000000042")}},
+	}}
+	var received fhir.Parameters
+	s := ttpServer(t, "$searchPersonByIdentifier", http.StatusOK, res, &received)
+	defer s.Close()
+
+	r := &EpixResolver{Fhir: config.Fhir{Base: s.URL + "/fhir"}, Domain: "mpi", IdentifierDomain: "kis"}
+	id, err := r.Resolve("42")
+
+	assert.NoError(t, err)
+	assert.Equal(t, &Identifier{System: "https://ths-greifswald.de/epix/MPI", Value: "1001000000042"}, id)
+	assert.Equal(t, "mpi", parameter(received, "domain"))
+	assert.Equal(t, "42", parameter(received, "identifier"))
+	assert.Equal(t, "kis", parameter(received, "identifierDomain"))
+}
+
+func TestEpixResolveNotFound(t *testing.T) {
+	var received fhir.Parameters
+	s := ttpServer(t, "$searchPersonByIdentifier", http.StatusOK, fhir.Parameters{}, &received)
+	defer s.Close()
+
+	_, err := (&EpixResolver{Fhir: config.Fhir{Base: s.URL + "/fhir"}, Domain: "mpi", IdentifierDomain: "kis"}).Resolve("42")
+
+	assert.EqualError(t, err, "no MPI id found in E-PIX domain 'mpi'")
+}
@@ -0,0 +1,44 @@
+package identity
+
+import (
+	"consented/pkg/config"
+	"fmt"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"net/http"
+)
+
+// GpasResolver resolves the pseudonym of the patient id in a gPAS domain via
+// the $pseudonymize operation of the gPAS FHIR gateway
+type GpasResolver struct {
+	Fhir   config.Fhir
+	Domain string
+	// System of the pseudonyms (empty: as returned by gPAS)
+	System string
+	// Client of the FHIR gateway (nil: default with timeout)
+	Client *http.Client
+}
+
+func (r *GpasResolver) Resolve(pid string) (*Identifier, error) {
+	res, err := postOperation(r.Client, r.Fhir, "$pseudonymize", fhir.Parameters{
+		Parameter: []fhir.ParametersParameter{
+			{Name: "target", ValueString: of(r.Domain)},
+			{Name: "original", ValueString: of(pid)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range res.Parameter {
+		if p.Name != "pseudonym" {
+			continue
+		}
+		for _, part := range p.Part {
+			if part.Name == "pseudonym" {
+				return toIdentifier(part.ValueIdentifier, r.System)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no pseudonym found in gPAS domain '%s'", r.Domain)
+}
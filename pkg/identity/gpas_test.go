@@ -0,0 +1,63 @@
+package identity
+
+import (
+	"consented/pkg/config"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestGpasResolve(t *testing.T) {
+	res := fhir.Parameters{Parameter: []fhir.ParametersParameter{{
+		Name: "pseudonym",
+		Part: []fhir.ParametersParameter{
+			{Name: "original", ValueIdentifier: &fhir.Identifier{Value: of("42")}},
+			{Name: "pseudonym", ValueIdentifier: &fhir.Identifier{System: of("https://ths-greifswald.de/gpas"), Value: of("psn-42")}},
+		},
+	}}}
+	var received fhir.Parameters
+	s := ttpServer(t, "$pseudonymize", http.StatusOK, res, &received)
+	defer s.Close()
+
+	r := &GpasResolver{Fhir: config.Fhir{Base: s.URL + "/fhir/"}, Domain: "psn"}
+	id, err := r.Resolve("42")
+
+	assert.NoError(t, err)
+	assert.Equal(t, &Identifier{System: "https://ths-greifswald.de/gpas", Value: "psn-42"}, id)
+	assert.Equal(t, "psn", parameter(received, "target"))
+	assert.Equal(t, "42", parameter(received, "original"))
+
+	// configured system
+	r.System = "https://example.org/signer"
+	id, _ = r.Resolve("42")
+	assert.Equal(t, "https://example.org/signer", id.System)
+}
+
+func TestGpasResolveFails(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		res    fhir.Parameters
+	}{
+		{"notFound", http.StatusNotFound, fhir.Parameters{}},
+		{"missingPseudonym", http.StatusOK, fhir.Parameters{}},
+		{"emptyPseudonym", http.StatusOK, fhir.Parameters{Parameter: []fhir.ParametersParameter{{
+			Name: "pseudonym",
+			Part: []fhir.ParametersParameter{{Name: "pseudonym", ValueIdentifier: &fhir.Identifier{}}},
+		}}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var received fhir.Parameters
+			s := ttpServer(t, "$pseudonymize", c.status, c.res, &received)
+			defer s.Close()
+
+			id, err := (&GpasResolver{Fhir: config.Fhir{Base: s.URL + "/fhir"}, Domain: "psn"}).Resolve("42")
+
+			assert.Error(t, err)
+			assert.Nil(t, id)
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package identity
+
+import (
+	"bytes"
+	"consented/pkg/config"
+	"errors"
+	"fmt"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Identifier of a patient, e.g. a pseudonym or MPI id
+type Identifier struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+// ParseIdentifier parses a patient id, which is either a bare value or typed
+// as 'system|value'
+func ParseIdentifier(s string) (Identifier, error) {
+	system, value, typed := strings.Cut(s, "|")
+	if !typed {
+		system, value = "", s
+	}
+	if strings.TrimSpace(value) == "" {
+		return Identifier{}, fmt.Errorf("invalid patient identifier: '%s'. Expected 'value' or 'system|value'", s)
+	}
+	return Identifier{System: system, Value: value}, nil
+}
+
+func (i Identifier) String() string {
+	if i.System == "" {
+		return i.Value
+	}
+	return i.System + "|" + i.Value
+}
+
+// Resolver translates the patient id of the clinical systems to the id the
+// patient is registered with as gICS signer
+type Resolver interface {
+	Resolve(pid string) (*Identifier, error)
+}
+
+// NewResolver creates the configured resolver with cache. It returns nil if
+// identifier resolution is disabled.
+func NewResolver(c config.Identity) (Resolver, error) {
+	if c.Resolver == "" {
+		return nil, nil
+	}
+
+	// timeout defaults to ten seconds
+	timeout := defaultTimeout
+	if c.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	client := &http.Client{Timeout: timeout}
+
+	var r Resolver
+	switch c.Resolver {
+	case "gpas":
+		if c.Domain == "" {
+			return nil, errors.New("'identity.domain' is required for gPAS")
+		}
+		r = &GpasResolver{Fhir: c.Fhir, Domain: c.Domain, System: c.System, Client: client}
+	case "epix":
+		if c.Domain == "" || c.IdentifierDomain == "" {
+			return nil, errors.New("'identity.domain' and 'identity.identifier-domain' are required for E-PIX")
+		}
+		r = &EpixResolver{Fhir: c.Fhir, Domain: c.Domain, IdentifierDomain: c.IdentifierDomain, System: c.System, Client: client}
+	default:
+		return nil, fmt.Errorf("unknown identity resolver: '%s'. Expected 'gpas' or 'epix'", c.Resolver)
+	}
+	if c.Fhir.Base == "" {
+		return nil, errors.New("'identity.fhir.base' is required for identifier resolution")
+	}
+
+	// cache defaults to one hour
+	ttl := time.Hour
+	if c.CacheDuration != "" {
+		var err error
+		if ttl, err = time.ParseDuration(c.CacheDuration); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewCache(r, ttl), nil
+}
+
+// defaultTimeout of requests to the TTP's FHIR gateway
+const defaultTimeout = 10 * time.Second
+
+// defaultClient is used by resolvers without client
+var defaultClient = &http.Client{Timeout: defaultTimeout}
+
+// postOperation posts the parameters to the operation of the TTP's FHIR
+// gateway and returns the response parameters
+func postOperation(client *http.Client, c config.Fhir, operation string, params fhir.Parameters) (*fhir.Parameters, error) {
+	body, err := params.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimSuffix(c.Base, "/") + "/" + operation
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	if c.Auth != nil {
+		req.SetBasicAuth(c.Auth.User, c.Auth.Password)
+	}
+
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed with status %d: %s", operation, resp.StatusCode, string(data))
+	}
+
+	res, err := fhir.UnmarshalParameters(data)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// toIdentifier converts the FHIR identifier. The system defaults to the
+// configured one.
+func toIdentifier(id *fhir.Identifier, system string) (*Identifier, error) {
+	if id == nil || id.Value == nil || *id.Value == "" {
+		return nil, errors.New("missing identifier value")
+	}
+	if id.System != nil && system == "" {
+		system = *id.System
+	}
+	return &Identifier{System: system, Value: *id.Value}, nil
+}
+
+func of[E any](e E) *E {
+	return &e
+}
@@ -0,0 +1,107 @@
+package identity
+
+import (
+	"consented/pkg/config"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewResolver(t *testing.T) {
+	fhirBase := config.Fhir{Base: "http://localhost/fhir"}
+
+	cases := []struct {
+		name   string
+		config config.Identity
+		isNil  bool
+		error  bool
+	}{
+		{"disabled", config.Identity{}, true, false},
+		{"gpas", config.Identity{Resolver: "gpas", Fhir: fhirBase, Domain: "psn"}, false, false},
+		{"gpasMissingDomain", config.Identity{Resolver: "gpas", Fhir: fhirBase}, true, true},
+		{"epix", config.Identity{Resolver: "epix", Fhir: fhirBase, Domain: "mpi", IdentifierDomain: "kis"}, false, false},
+		{"epixMissingIdentifierDomain", config.Identity{Resolver: "epix", Fhir: fhirBase, Domain: "mpi"}, true, true},
+		{"missingBase", config.Identity{Resolver: "gpas", Domain: "psn"}, true, true},
+		{"invalidCacheDuration", config.Identity{Resolver: "gpas", Fhir: fhirBase, Domain: "psn", CacheDuration: "1 hour"}, true, true},
+		{"invalidTimeout", config.Identity{Resolver: "gpas", Fhir: fhirBase, Domain: "psn", Timeout: "10 seconds"}, true, true},
+		{"unknown", config.Identity{Resolver: "mosaic"}, true, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := NewResolver(c.config)
+
+			assert.Equal(t, c.error, err != nil)
+			assert.Equal(t, c.isNil, r == nil)
+		})
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	done := make(chan bool)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer s.Close()
+	defer close(done)
+
+	r, _ := NewResolver(config.Identity{Resolver: "gpas", Fhir: config.Fhir{Base: s.URL}, Domain: "psn", Timeout: "50ms"})
+	_, err := r.Resolve("42")
+
+	assert.ErrorContains(t, err, "Timeout")
+}
+
+func TestParseIdentifier(t *testing.T) {
+	cases := []struct {
+		name     string
+		pid      string
+		expected Identifier
+		error    bool
+	}{
+		{"bare", "42", Identifier{Value: "42"}, false},
+		{"typed", "https://example.org/kis|42", Identifier{System: "https://example.org/kis", Value: "42"}, false},
+		{"emptySystem", "|42", Identifier{Value: "42"}, false},
+		{"missingValue", "https://example.org/kis|", Identifier{}, true},
+		{"empty", "", Identifier{}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			id, err := ParseIdentifier(c.pid)
+
+			assert.Equal(t, c.error, err != nil)
+			assert.Equal(t, c.expected, id)
+		})
+	}
+
+	assert.Equal(t, "https://example.org/kis|42", Identifier{System: "https://example.org/kis", Value: "42"}.String())
+	assert.Equal(t, "42", Identifier{Value: "42"}.String())
+}
+
+// ttpServer returns the response parameters for the operation
+func ttpServer(t *testing.T, operation string, status int, res fhir.Parameters, received *fhir.Parameters) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/fhir/"+operation, req.URL.Path)
+		assert.Equal(t, "application/fhir+json", req.Header.Get("Content-Type"))
+
+		b, _ := io.ReadAll(req.Body)
+		*received, _ = fhir.UnmarshalParameters(b)
+
+		data, _ := res.MarshalJSON()
+		w.WriteHeader(status)
+		_, _ = w.Write(data)
+	}))
+}
+
+// parameter returns the string value of the named parameter
+func parameter(p fhir.Parameters, name string) string {
+	for _, e := range p.Parameter {
+		if e.Name == name && e.ValueString != nil {
+			return *e.ValueString
+		}
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultApiKeyHeader = "X-API-Key"
+	principalKey        = "principal"
+	// tokenPrefix marks the ids of bearer token subjects
+	tokenPrefix = "token:"
+)
+
+// Principal is the authenticated API client. Roles and claims are only
+// available for bearer token authentication.
+type Principal struct {
+	Name   string
+	Roles  []string
+	Claims jwt.MapClaims
+	// Bearer is true for bearer token subjects. Their names may collide with
+	// configured API clients, so they are only authorized by role.
+	Bearer bool
+}
+
+// id identifies the principal, e.g. as owner of subscriptions. Bearer token
+// subjects are prefixed, so they can't act as a configured API client.
+func (p *Principal) id() string {
+	if p.Bearer {
+		return tokenPrefix + p.Name
+	}
+	return p.Name
+}
+
+type authenticator struct {
+	legacy       config.Auth
+	clients      []config.Client
+	apiKeyHeader string
+	tokens       *tokenValidator
+}
+
+func newAuthenticator(c config.Http) (*authenticator, error) {
+	header := c.ApiKeyHeader
+	if header == "" {
+		header = defaultApiKeyHeader
+	}
+
+	a := &authenticator{
+		legacy:       c.Auth,
+		clients:      c.Clients,
+		apiKeyHeader: header,
+	}
+
+	// bearer token authentication
+	if c.Oidc.Issuer != "" {
+		v, err := newTokenValidator(c.Oidc)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = v
+	}
+
+	return a, nil
+}
+
+// middleware authenticates the request via bearer token, API key or Basic
+// Auth and stores the client name (gin.AuthUserKey) and Principal with the
+// context.
+func (a *authenticator) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token, ok := bearerToken(c.Request); ok {
+			p, err := a.validateToken(token)
+			if err != nil {
+				log.Debug().Err(err).Msg("Bearer token validation failed")
+				c.Header("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			setPrincipal(c, p)
+			return
+		}
+
+		name, ok := a.authenticate(c.Request)
+		if !ok {
+			c.Header("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		setPrincipal(c, &Principal{Name: name})
+	}
+}
+
+func setPrincipal(c *gin.Context, p *Principal) {
+	c.Set(gin.AuthUserKey, p.Name)
+	c.Set(principalKey, p)
+}
+
+// principal returns the authenticated client of the request
+func principal(c *gin.Context) *Principal {
+	if p, ok := c.Get(principalKey); ok {
+		return p.(*Principal)
+	}
+	return nil
+}
+
+// principalId returns the id of the request's principal (see Principal.id)
+func principalId(c *gin.Context) string {
+	if p := principal(c); p != nil {
+		return p.id()
+	}
+	return c.GetString(gin.AuthUserKey)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:]), true
+	}
+	return "", false
+}
+
+func (a *authenticator) validateToken(token string) (*Principal, error) {
+	if a.tokens == nil {
+		return nil, jwt.ErrTokenUnverifiable
+	}
+	return a.tokens.validate(token)
+}
+
+func (a *authenticator) authenticate(r *http.Request) (string, bool) {
+	// API key
+	if key := r.Header.Get(a.apiKeyHeader); key != "" {
+		for _, cl := range a.clients {
+			if cl.ApiKey != "" && equals(cl.ApiKey, key) {
+				return cl.Name, true
+			}
+		}
+		return "", false
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	// configured clients
+	for _, cl := range a.clients {
+		if cl.User == "" || cl.PasswordHash == "" || cl.User != user {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(cl.PasswordHash), []byte(password)) == nil {
+			return clientName(cl), true
+		}
+		return "", false
+	}
+
+	// single user (app.http.auth)
+	if a.legacy.User != "" && equals(a.legacy.User, user) && equals(a.legacy.Password, password) {
+		return user, true
+	}
+
+	return "", false
+}
+
+func clientName(c config.Client) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.User
+}
+
+// equals compares strings in constant time
+func equals(expected, actual string) bool {
+	e := sha256.Sum256([]byte(expected))
+	a := sha256.Sum256([]byte(actual))
+	return subtle.ConstantTimeCompare(e[:], a[:]) == 1
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// bcrypt hash of "secret"
+const testPasswordHash = "$2a$04$GiF1EXTWjcmka3PEZVMPJOXeE4JrEdfQJgssThcCePq0MQGZVBwp2"
+
+func TestAuthenticate(t *testing.T) {
+	a, _ := newAuthenticator(config.Http{
+		Auth: testAuth,
+		Clients: []config.Client{
+			{Name: "registry", User: "reg", PasswordHash: testPasswordHash},
+			{Name: "pipeline", ApiKey: "key-42"},
+		},
+	})
+
+	cases := []struct {
+		name     string
+		user     string
+		password string
+		apiKey   string
+		client   string
+		ok       bool
+	}{
+		{name: "legacyUser", user: "test", password: "test", client: "test", ok: true},
+		{name: "hashedPassword", user: "reg", password: "secret", client: "registry", ok: true},
+		{name: "wrongPassword", user: "reg", password: "test", ok: false},
+		{name: "unknownUser", user: "foo", password: "bar", ok: false},
+		{name: "apiKey", apiKey: "key-42", client: "pipeline", ok: true},
+		{name: "wrongApiKey", apiKey: "key-43", ok: false},
+		{name: "noCredentials", ok: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/consent/status/42", nil)
+			if c.user != "" {
+				req.SetBasicAuth(c.user, c.password)
+			}
+			if c.apiKey != "" {
+				req.Header.Set(defaultApiKeyHeader, c.apiKey)
+			}
+
+			client, ok := a.authenticate(req)
+
+			assert.Equal(t, c.ok, ok)
+			assert.Equal(t, c.client, client)
+		})
+	}
+}
+
+func TestAuthenticateEmptyLegacyUser(t *testing.T) {
+	a, _ := newAuthenticator(config.Http{})
+
+	req, _ := http.NewRequest(http.MethodPost, "/consent/status/42", nil)
+	req.SetBasicAuth("", "")
+
+	_, ok := a.authenticate(req)
+
+	assert.False(t, ok)
+}
+
+func ginTestContext(w *httptest.ResponseRecorder) (*gin.Context, *gin.Engine) {
+	ctx, r := gin.CreateTestContext(w)
+	ctx.Request, _ = http.NewRequest(http.MethodPost, "/consent/status/42", nil)
+	return ctx, r
+}
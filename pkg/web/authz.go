@@ -0,0 +1,100 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"consented/pkg/consent"
+	"fmt"
+	"slices"
+)
+
+const (
+	deniedOmit      = "omit"
+	deniedForbidden = "forbidden"
+	wildcard        = "*"
+)
+
+// authorizer grants API clients access to domains based on the configured
+// rules. A nil authorizer or one without rules allows all domains.
+type authorizer struct {
+	rules  []config.Rule
+	denied string
+}
+
+func newAuthorizer(c config.Authorization) (*authorizer, error) {
+	denied := c.Denied
+	switch denied {
+	case "":
+		denied = deniedOmit
+	case deniedOmit, deniedForbidden:
+	default:
+		return nil, fmt.Errorf("invalid 'app.authorization.denied' value: '%s'", c.Denied)
+	}
+
+	return &authorizer{rules: c.Rules, denied: denied}, nil
+}
+
+// reportDenied is true if denied domains are part of the response
+func (a *authorizer) reportDenied() bool {
+	return a != nil && a.denied == deniedForbidden
+}
+
+func (a *authorizer) isAllowed(p *Principal, d consent.Domain) bool {
+	if a == nil || len(a.rules) == 0 {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+
+	for _, r := range a.rules {
+		if m := ruleMatcher(r); m.applies(p) && m.grants(d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isWriteAllowed is true, if a rule grants write access to the domain. Unlike
+// read access, write access must always be granted explicitly.
+func (a *authorizer) isWriteAllowed(p *Principal, d consent.Domain) bool {
+	if a == nil || p == nil {
+		return false
+	}
+
+	for _, r := range a.rules {
+		if m := ruleMatcher(r); r.Write && m.applies(p) && m.grants(d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ruleMatcher config.Rule
+
+// applies is true, if the rule lists the principal's role or, unless it is a
+// bearer token subject, the API client
+func (r ruleMatcher) applies(p *Principal) bool {
+	if !p.Bearer && (slices.Contains(r.Clients, wildcard) || slices.Contains(r.Clients, p.Name)) {
+		return true
+	}
+	for _, role := range p.Roles {
+		if slices.Contains(r.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ruleMatcher) grants(d consent.Domain) bool {
+	if slices.Contains(r.Domains, wildcard) || slices.Contains(r.Domains, d.Name) {
+		return true
+	}
+	for _, dep := range d.Departments {
+		if slices.Contains(r.Departments, dep) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+package web
+
+import (
+	"consented/pkg/audit"
+	"consented/pkg/consent"
+	"consented/pkg/identity"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"net/http"
+	"path"
+	"time"
+)
+
+type DecisionRequest struct {
+	PatientId       string                  `json:"patient-id" binding:"required"`
+	Domain          string                  `json:"domain" binding:"required"`
+	Template        string                  `json:"template"`
+	TemplateVersion string                  `json:"template-version" binding:"required"`
+	Signed          string                  `json:"signed" binding:"required"`
+	Policies        []PolicyDecisionRequest `json:"policies" binding:"required,min=1,dive"`
+}
+
+type PolicyDecisionRequest struct {
+	Code   string `json:"code" binding:"required"`
+	Permit *bool  `json:"permit" binding:"required"`
+}
+
+// handleDecision records the patient's consent decision in gICS and responds
+// with the new status of the domain
+func (s *Server) handleDecision(c *gin.Context) {
+
+	// bind to struct
+	var r DecisionRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pid, err := identity.ParseIdentifier(r.PatientId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	signed, err := parseDateParam("signed", r.Signed, s.timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if signed.After(s.clock.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "signature date must not be in the future"})
+		return
+	}
+
+	d, ok := s.writableDomain(c, r.Domain)
+	if !ok {
+		return
+	}
+	signerId, ok := s.requireSignerId(c, pid, d)
+	if !ok {
+		return
+	}
+
+	// validate against the domain's templates
+	qs, err := s.gicsClient.GetQuestionnaires(d.Name)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to get templates from gICS"})
+		return
+	}
+	decision := consent.Decision{
+		SignerId:        signerId,
+		Template:        r.Template,
+		TemplateVersion: r.TemplateVersion,
+		Signed:          *signed,
+		Author:          c.GetString(gin.AuthUserKey),
+	}
+	for _, p := range r.Policies {
+		decision.Policies = append(decision.Policies, consent.PolicyDecision{Code: p.Code, Permit: *p.Permit})
+	}
+	doc, err := consent.NewConsentDocument(decision, qs)
+	if errors.Is(err, consent.ErrInvalidDecision) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create consent document")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create consent document"})
+		return
+	}
+
+	if !s.addConsent(c, d, doc) {
+		return
+	}
+	s.respondWritten(c, r.PatientId, pid, signerId, d)
+}
+
+type WithdrawalRequest struct {
+	PatientId string `uri:"pid" binding:"required"`
+	Domain    string `uri:"domain" binding:"required"`
+}
+
+// handleWithdraw records the withdrawal of the patient's consent using the
+// domain's withdrawal template and responds with the new status of the domain
+func (s *Server) handleWithdraw(c *gin.Context) {
+
+	// bind to struct
+	var r WithdrawalRequest
+	// path parameters are matched by route
+	_ = c.ShouldBindUri(&r)
+	pid, err := identity.ParseIdentifier(r.PatientId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// withdrawal is signed now, unless dated otherwise
+	signed, err := parseDateParam("signed", c.Query("signed"), s.timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := s.clock.Now()
+	if signed == nil {
+		signed = &now
+	} else if signed.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "signature date must not be in the future"})
+		return
+	}
+
+	d, ok := s.writableDomain(c, r.Domain)
+	if !ok {
+		return
+	}
+	if d.WithdrawalUri == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": consent.ErrNoWithdrawalTemplate.Error()})
+		return
+	}
+	signerId, ok := s.requireSignerId(c, pid, d)
+	if !ok {
+		return
+	}
+
+	qs, err := s.gicsClient.GetQuestionnaires(d.Name)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to get templates from gICS"})
+		return
+	}
+	doc, err := consent.NewWithdrawalDocument(consent.Decision{
+		SignerId: signerId,
+		Signed:   *signed,
+		Author:   c.GetString(gin.AuthUserKey),
+	}, d, qs)
+	// the withdrawal template can't be used
+	if errors.Is(err, consent.ErrNoWithdrawalTemplate) || errors.Is(err, consent.ErrInvalidDecision) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create withdrawal document")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create withdrawal document"})
+		return
+	}
+
+	if !s.addConsent(c, d, doc) {
+		return
+	}
+	s.respondWritten(c, r.PatientId, pid, signerId, d)
+}
+
+// writableDomain returns the domain, if the client is allowed to record
+// consents. Otherwise, the error response is sent.
+func (s *Server) writableDomain(c *gin.Context, name string) (consent.Domain, bool) {
+	d, ok := s.findDomain(name)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "domain not found"})
+		return d, false
+	}
+	if !s.authz.isWriteAllowed(principal(c), d) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "write access to domain denied"})
+		return d, false
+	}
+	return d, true
+}
+
+// addConsent submits the document to gICS. Otherwise, the error response is
+// sent.
+func (s *Server) addConsent(c *gin.Context, d consent.Domain, doc *fhir.Bundle) bool {
+	err := s.gicsClient.AddConsent(d, doc)
+	if errors.Is(err, consent.ErrTooManyRequests) {
+		tooManyRequests(c, time.Second)
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to add consent to gICS"})
+		return false
+	}
+	return true
+}
+
+// respondWritten responds with the domain's status after the consent was
+// recorded
+func (s *Server) respondWritten(c *gin.Context, rawPid string, pid identity.Identifier, signerId identity.Identifier, d consent.Domain) {
+	ds, err := s.createDomainStatus(pid, d, nil)
+	if err != nil {
+		failed := failedStatus(d)
+		ds = &failed
+	}
+
+	s.auditInteraction(c, audit.Create, rawPid, []consent.DomainStatus{*ds})
+	c.JSON(http.StatusCreated, ds)
+
+	// notify internal subscribers like gICS would
+	err = s.events.Publish(consent.Notification{
+		Type:      consent.AddConsentNotification,
+		ClientId:  c.GetString(gin.AuthUserKey),
+		Domain:    d.Name,
+		SignerIds: []consent.SignerId{{IdType: path.Base(signerId.System), Id: signerId.Value}},
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("domain", d.Name).Msg("Failed to queue notification of recorded consent. Subscribers are notified with the next check.")
+	}
+}
@@ -0,0 +1,196 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"consented/pkg/consent"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+var writeRule = &config.Authorization{Rules: []config.Rule{{Clients: []string{"test"}, Domains: []string{"*"}, Write: true}}}
+
+func TestHandleDecision(t *testing.T) {
+
+	cases := []HandlerTestCase{
+		{
+			name:           "decisionSuccess",
+			requestUrl:     "/consent/decision",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			body:           `{"patient-id":"42","domain":"Test","template-version":"1.0","signed":"2024-06-01","policies":[{"code":"IDAT_TEST","permit":true}]}`,
+			responseStatus: http.StatusCreated,
+			response:       `{"domain":"Test","description":"Test Consent","document-ref":null,"status":"accepted","last-updated":"<<PRESENCE>>","ask-consent": false,"ask-consent-reason":"consented","policies":"<<PRESENCE>>"}`,
+		},
+		{
+			name:           "decisionWithoutWritePermission",
+			requestUrl:     "/consent/decision",
+			Auth:           testAuth,
+			body:           `{"patient-id":"42","domain":"Test","template-version":"1.0","signed":"2024-06-01","policies":[{"code":"IDAT_TEST","permit":true}]}`,
+			responseStatus: http.StatusForbidden,
+			response:       `{"error":"write access to domain denied"}`,
+		},
+		{
+			name:           "decisionUnknownDomain",
+			requestUrl:     "/consent/decision",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			body:           `{"patient-id":"42","domain":"Other","template-version":"1.0","signed":"2024-06-01","policies":[{"code":"IDAT_TEST","permit":true}]}`,
+			responseStatus: http.StatusNotFound,
+			response:       `{"error":"domain not found"}`,
+		},
+		{
+			name:           "decisionMissingPermit",
+			requestUrl:     "/consent/decision",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			body:           `{"patient-id":"42","domain":"Test","template-version":"1.0","signed":"2024-06-01","policies":[{"code":"IDAT_TEST"}]}`,
+			responseStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "decisionInvalidSignatureDate",
+			requestUrl:     "/consent/decision",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			body:           `{"patient-id":"42","domain":"Test","template-version":"1.0","signed":"01.06.2024","policies":[{"code":"IDAT_TEST","permit":true}]}`,
+			responseStatus: http.StatusBadRequest,
+			response:       `{"error":"invalid 'signed' parameter: '01.06.2024'. Expected RFC 3339 date or date-time"}`,
+		},
+		{
+			name:           "decisionSignedInFuture",
+			requestUrl:     "/consent/decision",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			body:           `{"patient-id":"42","domain":"Test","template-version":"1.0","signed":"3000-01-01","policies":[{"code":"IDAT_TEST","permit":true}]}`,
+			responseStatus: http.StatusBadRequest,
+			response:       `{"error":"signature date must not be in the future"}`,
+		},
+		{
+			name:           "decisionUnknownPolicy",
+			requestUrl:     "/consent/decision",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			body:           `{"patient-id":"42","domain":"Test","template-version":"1.0","signed":"2024-06-01","policies":[{"code":"MDAT_TEST","permit":true}]}`,
+			responseStatus: http.StatusBadRequest,
+			response:       `{"error":"invalid consent decision: policy 'MDAT_TEST' is not part of template 'Test' (1.0)"}`,
+		},
+		{
+			name:           "decisionUnknownTemplateVersion",
+			requestUrl:     "/consent/decision",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			body:           `{"patient-id":"42","domain":"Test","template-version":"2.0","signed":"2024-06-01","policies":[{"code":"IDAT_TEST","permit":true}]}`,
+			responseStatus: http.StatusBadRequest,
+			response:       `{"error":"invalid consent decision: template version '2.0' not found"}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handler(t, c)
+		})
+	}
+}
+
+func TestHandleWithdraw(t *testing.T) {
+
+	cases := []HandlerTestCase{
+		{
+			name:           "withdrawSuccess",
+			requestUrl:     "/consent/withdraw/42/Test",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			responseStatus: http.StatusCreated,
+			response:       `{"domain":"Test","description":"Test Consent","document-ref":null,"status":"accepted","last-updated":"<<PRESENCE>>","ask-consent": false,"ask-consent-reason":"consented","policies":"<<PRESENCE>>"}`,
+		},
+		{
+			name:           "withdrawSigned",
+			requestUrl:     "/consent/withdraw/42/Test?signed=2024-06-01",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			responseStatus: http.StatusCreated,
+			response:       `{"domain":"Test","description":"Test Consent","document-ref":null,"status":"accepted","last-updated":"<<PRESENCE>>","ask-consent": false,"ask-consent-reason":"consented","policies":"<<PRESENCE>>"}`,
+		},
+		{
+			name:           "withdrawSignedInFuture",
+			requestUrl:     "/consent/withdraw/42/Test?signed=3000-01-01",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			responseStatus: http.StatusBadRequest,
+			response:       `{"error":"signature date must not be in the future"}`,
+		},
+		{
+			name:           "withdrawTemplateWithoutPolicies",
+			requestUrl:     "/consent/withdraw/42/Test",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			withdrawalUri:  "Leer",
+			responseStatus: http.StatusConflict,
+			response:       `{"error":"invalid consent decision: missing policies"}`,
+		},
+		{
+			name:           "withdrawWithoutWritePermission",
+			requestUrl:     "/consent/withdraw/42/Test",
+			Auth:           testAuth,
+			responseStatus: http.StatusForbidden,
+			response:       `{"error":"write access to domain denied"}`,
+		},
+		{
+			name:           "withdrawUnknownDomain",
+			requestUrl:     "/consent/withdraw/42/Other",
+			Auth:           testAuth,
+			authorization:  writeRule,
+			responseStatus: http.StatusNotFound,
+			response:       `{"error":"domain not found"}`,
+		},
+		{
+			name:           "withdrawGetRequest",
+			requestUrl:     "/consent/withdraw/42/Test",
+			method:         http.MethodGet,
+			Auth:           testAuth,
+			authorization:  writeRule,
+			responseStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handler(t, c)
+		})
+	}
+}
+
+func TestIsWriteAllowed(t *testing.T) {
+	d := consent.Domain{Name: "Test"}
+	registry := &Principal{Name: "registry"}
+
+	cases := []struct {
+		name     string
+		authz    *authorizer
+		expected bool
+	}{
+		{"noAuthorizer", nil, false},
+		{"noRules", &authorizer{}, false},
+		{"readOnly", &authorizer{rules: []config.Rule{{Clients: []string{"registry"}, Domains: []string{"*"}}}}, false},
+		{"write", &authorizer{rules: []config.Rule{{Clients: []string{"registry"}, Domains: []string{"Test"}, Write: true}}}, true},
+		{"writeOtherDomain", &authorizer{rules: []config.Rule{{Clients: []string{"registry"}, Domains: []string{"Other"}, Write: true}}}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, c.authz.isWriteAllowed(registry, d))
+		})
+	}
+}
+
+func TestIsWriteAllowedBearerToken(t *testing.T) {
+	d := consent.Domain{Name: "Test"}
+	a := &authorizer{rules: []config.Rule{
+		{Clients: []string{"registry"}, Domains: []string{"Test"}, Write: true},
+		{Roles: []string{"registrar"}, Domains: []string{"Test"}, Write: true},
+	}}
+
+	// token subjects don't match rules by client name
+	assert.False(t, a.isWriteAllowed(&Principal{Name: "registry", Bearer: true}, d))
+	assert.True(t, a.isWriteAllowed(&Principal{Name: "registry", Roles: []string{"registrar"}, Bearer: true}, d))
+}
@@ -0,0 +1,132 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"expvar"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var rateLimited = expvar.NewMap("rate_limited_requests")
+
+// rateLimiter limits requests per authenticated API client and failed
+// authentications per client IP with a token bucket each.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	// idle limiters are full again and evicted
+	idle time.Duration
+
+	mu        sync.Mutex
+	limiters  map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+type limiterEntry struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+func newRateLimiter(c config.RateLimit) *rateLimiter {
+	if c.RequestsPerSecond <= 0 {
+		return nil
+	}
+
+	burst := c.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	// time to refill the bucket, at least a minute
+	idle := max(time.Duration(float64(burst)/c.RequestsPerSecond*float64(time.Second)), time.Minute)
+
+	return &rateLimiter{
+		limit:    rate.Limit(c.RequestsPerSecond),
+		burst:    burst,
+		idle:     idle,
+		limiters: make(map[string]*limiterEntry),
+	}
+}
+
+// middleware limits requests of the authenticated client. It runs after the
+// authentication.
+func (l *rateLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l == nil {
+			return
+		}
+
+		name, key := c.GetString(gin.AuthUserKey), "client:"+principalId(c)
+		// clients without name (e.g. tokens without name claim and subject) by IP
+		if name == "" {
+			name = c.ClientIP()
+			key = "ip:" + name
+		}
+
+		r := l.get(key).Reserve()
+		if delay := r.Delay(); delay > 0 {
+			r.Cancel()
+			rateLimited.Add(name, 1)
+			tooManyRequests(c, delay)
+		}
+	}
+}
+
+// authenticate runs the authentication and limits failed authentications per
+// client IP, e.g. guessed passwords or API keys
+func (l *rateLimiter) authenticate(auth gin.HandlerFunc) gin.HandlerFunc {
+	if l == nil {
+		return auth
+	}
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		lim := l.get("ip:" + ip)
+
+		if lim.Tokens() < 1 {
+			r := lim.Reserve()
+			r.Cancel()
+			rateLimited.Add(ip, 1)
+			tooManyRequests(c, r.Delay())
+			return
+		}
+
+		// successful authentications don't count
+		auth(c)
+		if c.IsAborted() && c.Writer.Status() == http.StatusUnauthorized {
+			lim.Allow()
+		}
+	}
+}
+
+func (l *rateLimiter) get(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > l.idle {
+		for k, e := range l.limiters {
+			if now.Sub(e.seen) > l.idle {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	e, ok := l.limiters[key]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = e
+	}
+	e.seen = now
+
+	return e.limiter
+}
+
+func tooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests"})
+}
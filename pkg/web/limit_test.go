@@ -0,0 +1,143 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"consented/pkg/consent"
+	"consented/pkg/identity"
+	"github.com/gin-gonic/gin"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(config.RateLimit{RequestsPerSecond: 0.5, Burst: 2})
+
+	request := func(client string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := ginTestContext(w)
+		ctx.Set(gin.AuthUserKey, client)
+		l.middleware()(ctx)
+		return w
+	}
+
+	// burst
+	assert.Equal(t, http.StatusOK, request("registry").Code)
+	assert.Equal(t, http.StatusOK, request("registry").Code)
+
+	w := request("registry")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	// other clients are not affected
+	assert.Equal(t, http.StatusOK, request("pipeline").Code)
+}
+
+func TestRateLimiterWithoutClientName(t *testing.T) {
+	l := newRateLimiter(config.RateLimit{RequestsPerSecond: 0.5, Burst: 1})
+
+	request := func(ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := ginTestContext(w)
+		ctx.Request.RemoteAddr = ip + ":1234"
+		// token without name claim and subject
+		setPrincipal(ctx, &Principal{Bearer: true})
+		l.middleware()(ctx)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request("10.0.0.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.1").Code)
+	// limited per IP
+	assert.Equal(t, http.StatusOK, request("10.0.0.2").Code)
+}
+
+func TestRateLimitFailedAuthentication(t *testing.T) {
+	l := newRateLimiter(config.RateLimit{RequestsPerSecond: 0.5, Burst: 2})
+	auth, _ := newAuthenticator(config.Http{Auth: testAuth})
+	authenticate := l.authenticate(auth.middleware())
+
+	request := func(user string, password string) int {
+		w := httptest.NewRecorder()
+		ctx, _ := ginTestContext(w)
+		ctx.Request.SetBasicAuth(user, password)
+		authenticate(ctx)
+		return w.Code
+	}
+
+	// successful authentications are not limited
+	for range 3 {
+		assert.Equal(t, http.StatusOK, request("test", "test"))
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("test", "guess"))
+	assert.Equal(t, http.StatusUnauthorized, request("test", "guess"))
+	assert.Equal(t, http.StatusTooManyRequests, request("test", "guess"))
+	// the client IP is blocked until the bucket refills
+	assert.Equal(t, http.StatusTooManyRequests, request("test", "test"))
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	l := newRateLimiter(config.RateLimit{RequestsPerSecond: 10, Burst: 10})
+
+	l.get("client:registry")
+	l.get("client:pipeline")
+	l.limiters["client:registry"].seen = time.Now().Add(-2 * time.Minute)
+	l.lastSweep = time.Now().Add(-2 * time.Minute)
+
+	l.get("client:pipeline")
+	assert.Len(t, l.limiters, 1)
+	assert.Contains(t, l.limiters, "client:pipeline")
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := newRateLimiter(config.RateLimit{})
+
+	assert.Nil(t, l)
+
+	w := httptest.NewRecorder()
+	ctx, _ := ginTestContext(w)
+	l.middleware()(ctx)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHandleConsentStatusTooManyRequests(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	client := consent.NewLimitedClient(&blockingGicsClient{block: block}, 1, 10*time.Millisecond)
+	go func() {
+		_, _ = client.GetConsentPolicies(identity.Identifier{Value: "1"}, consent.Domain{})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	auth, _ := newAuthenticator(config.Http{Auth: testAuth})
+	s := &Server{
+		auth:        auth,
+		gicsClient:  client,
+		domainCache: &consent.DomainCache{Domains: []consent.Domain{{Name: "Test"}}},
+		clock:       consent.SystemClock{},
+	}
+
+	testRoute(t, s, HandlerTestCase{
+		method:         http.MethodPost,
+		requestUrl:     "/consent/status/42",
+		Auth:           testAuth,
+		responseStatus: http.StatusTooManyRequests,
+		response:       `{"error": "too many requests"}`,
+	})
+}
+
+type blockingGicsClient struct {
+	TestGicsClient
+	block chan struct{}
+}
+
+func (c *blockingGicsClient) GetConsentPolicies(pid identity.Identifier, domain consent.Domain) (*fhir.Bundle, error) {
+	<-c.block
+	return c.TestGicsClient.GetConsentPolicies(pid, domain)
+}
@@ -0,0 +1,76 @@
+package web
+
+import (
+	"consented/pkg/consent"
+	"consented/pkg/identity"
+	"consented/pkg/webhook"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"slices"
+)
+
+// handleNotification accepts notifications of the gICS notification service
+// and publishes them to internal subscribers. Only configured API clients may
+// send them, bearer token subjects could be named like one.
+func (s *Server) handleNotification(c *gin.Context) {
+	p := principal(c)
+	client := c.GetString(gin.AuthUserKey)
+	if p == nil || p.Bearer || !slices.Contains(s.config.Gics.Notifications.Clients, client) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "client not allowed to send notifications"})
+		return
+	}
+
+	data, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	n, err := consent.ParseNotification(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Debug().Str("type", n.Type).Str("domain", n.Domain).Str("client", client).Msg("Received gICS notification")
+	if err = s.events.Publish(n); err != nil {
+		log.Warn().Err(err).Str("type", n.Type).Str("domain", n.Domain).Msg("Failed to queue gICS notification")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// refreshDomains updates the domain cache and the signer ids of subscribed
+// patients, if the notification is about changed domains, templates or
+// policies, or an unknown domain
+func (s *Server) refreshDomains(n consent.Notification) {
+	if _, known := s.findDomain(n.Domain); n.AffectsDomains() || (n.Domain != "" && !known) {
+		s.domainCache.Refresh()
+		s.reindexSigners()
+	}
+}
+
+// notifyWebhooks re-evaluates the subscribed patients, whose signer id in the
+// notification's domain is affected
+func (s *Server) notifyWebhooks(n consent.Notification) {
+	d, ok := s.findDomain(n.Domain)
+	if !ok || len(n.SignerIds) == 0 {
+		return
+	}
+	affected := make([]identity.Identifier, 0, len(n.SignerIds))
+	for _, id := range n.SignerIds {
+		affected = append(affected, d.SignerIdentifier(id))
+	}
+
+	pids := s.signers.lookup(d.Name, affected)
+	if len(pids) == 0 {
+		return
+	}
+	s.webhooks.CheckPatients(func(sub webhook.Subscription, pid string) bool {
+		if len(sub.Domains) > 0 && !slices.Contains(sub.Domains, d.Name) {
+			return false
+		}
+		return pids[pid]
+	})
+}
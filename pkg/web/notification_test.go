@@ -0,0 +1,183 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"consented/pkg/consent"
+	"consented/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHandleNotification(t *testing.T) {
+
+	cases := []HandlerTestCase{
+		{
+			name:           "notificationAccepted",
+			requestUrl:     "/gics/notification",
+			Auth:           testAuth,
+			notifications:  []string{"test"},
+			body:           `{"type":"GICS.AddConsent","consentKey":{"consentTemplateKey":{"domainName":"Test"},"signerIds":[{"idType":"Patienten-ID","id":"42"}]}}`,
+			responseStatus: http.StatusAccepted,
+		},
+		{
+			name:           "notificationClientNotAllowed",
+			requestUrl:     "/gics/notification",
+			Auth:           testAuth,
+			notifications:  []string{"gics"},
+			body:           `{"type":"GICS.AddConsent"}`,
+			responseStatus: http.StatusForbidden,
+			response:       `{"error":"client not allowed to send notifications"}`,
+		},
+		{
+			name:           "notificationInvalid",
+			requestUrl:     "/gics/notification",
+			Auth:           testAuth,
+			notifications:  []string{"test"},
+			body:           `{"domainName":"Test"}`,
+			responseStatus: http.StatusBadRequest,
+			response:       `{"error":"invalid gICS notification: missing type"}`,
+		},
+		{
+			name:           "notificationUnauthenticated",
+			requestUrl:     "/gics/notification",
+			Auth:           config.Auth{User: "gics", Password: "wrong"},
+			notifications:  []string{"gics"},
+			body:           `{"type":"GICS.AddConsent"}`,
+			responseStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "notificationsDisabled",
+			requestUrl:     "/gics/notification",
+			Auth:           testAuth,
+			body:           `{"type":"GICS.AddConsent"}`,
+			responseStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handler(t, c)
+		})
+	}
+}
+
+func TestHandleNotificationFromToken(t *testing.T) {
+	s := &Server{config: config.AppConfig{Gics: config.Gics{Notifications: config.Notifications{Enabled: true, Clients: []string{"gics"}}}}}
+
+	w := httptest.NewRecorder()
+	ctx, _ := ginTestContext(w)
+	ctx.Request.Body = io.NopCloser(strings.NewReader(`{"type":"GICS.UpdateDomain"}`))
+	// bearer token subject named like the notification client
+	setPrincipal(ctx, &Principal{Name: "gics", Bearer: true})
+
+	s.handleNotification(ctx)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestRefreshDomains(t *testing.T) {
+	cases := []struct {
+		name      string
+		n         consent.Notification
+		refreshed bool
+	}{
+		{"consentOfKnownDomain", consent.Notification{Type: "GICS.AddConsent", Domain: "Test"}, false},
+		{"consentOfUnknownDomain", consent.Notification{Type: "GICS.AddConsent", Domain: "Other"}, true},
+		{"domainUpdated", consent.Notification{Type: "GICS.UpdateDomain", Domain: "Test"}, true},
+		{"templateAdded", consent.Notification{Type: "GICS.AddConsentTemplate"}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Server{signers: newSignerIndex()}
+			s.domainCache = consent.NewDomainCache(&TestGicsClient{}, -1, consent.Defaults{})
+			s.domainCache.Domains = []consent.Domain{{Name: "Test"}}
+
+			s.refreshDomains(c.n)
+
+			// the test client has no domains
+			assert.Equal(t, c.refreshed, len(s.domainCache.Domains) == 0)
+		})
+	}
+}
+
+func TestNotifyWebhooks(t *testing.T) {
+	d := consent.Domain{
+		Name:            "Test",
+		PersonIdSystem:  "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID",
+		PersonIdSystems: []string{"https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID", "https://ths-greifswald.de/fhir/gics/identifiers/Pseudonym"},
+	}
+
+	var mu sync.Mutex
+	var evaluated []string
+	evaluate := func(_ webhook.Subscription, pid string) ([]consent.DomainStatus, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		evaluated = append(evaluated, pid)
+		return nil, nil
+	}
+
+	s := &Server{signers: newSignerIndex()}
+	s.domainCache = consent.NewDomainCache(nil, -1, consent.Defaults{})
+	s.domainCache.Domains = []consent.Domain{d}
+	s.webhooks, _ = webhook.NewManager(config.Webhooks{Enabled: true}, evaluate, nil)
+	_, _ = s.webhooks.Subscribe(webhook.Subscription{Client: "registry", Url: "http://localhost", Patients: []string{"42", "43", "https://ths-greifswald.de/fhir/gics/identifiers/Pseudonym|psn"}})
+	_, _ = s.webhooks.Subscribe(webhook.Subscription{Client: "biobank", Url: "http://localhost", Patients: []string{"42"}, Domains: []string{"Other"}})
+	// wait for the initial evaluation
+	s.webhooks.Close()
+	s.reindexSigners()
+
+	cases := []struct {
+		name      string
+		n         consent.Notification
+		evaluated []string
+	}{
+		{"primarySystem", consent.Notification{Domain: "Test", SignerIds: []consent.SignerId{{IdType: "Patienten-ID", Id: "42"}}}, []string{"42"}},
+		{"otherSystem", consent.Notification{Domain: "Test", SignerIds: []consent.SignerId{{IdType: "Pseudonym", Id: "psn"}}}, []string{"https://ths-greifswald.de/fhir/gics/identifiers/Pseudonym|psn"}},
+		{"notWatched", consent.Notification{Domain: "Test", SignerIds: []consent.SignerId{{IdType: "Patienten-ID", Id: "44"}}}, nil},
+		{"unknownDomain", consent.Notification{Domain: "Other", SignerIds: []consent.SignerId{{IdType: "Patienten-ID", Id: "42"}}}, nil},
+		{"withoutSignerIds", consent.Notification{Domain: "Test"}, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			evaluated = nil
+
+			s.notifyWebhooks(c.n)
+
+			assert.Equal(t, c.evaluated, evaluated)
+		})
+	}
+}
+
+func TestNotifyWebhooksResolvesOnSubscription(t *testing.T) {
+	d := consent.Domain{Name: "Test", PersonIdSystem: "https://ths-greifswald.de/gpas"}
+
+	var evaluated []string
+	evaluate := func(_ webhook.Subscription, pid string) ([]consent.DomainStatus, error) {
+		evaluated = append(evaluated, pid)
+		return nil, nil
+	}
+
+	r := &testResolver{}
+	s := &Server{signers: newSignerIndex(), resolver: r}
+	s.domainCache = &consent.DomainCache{Domains: []consent.Domain{d}}
+	s.webhooks, _ = webhook.NewManager(config.Webhooks{Enabled: true}, evaluate, nil)
+	s.indexPatients(s.signers, []string{"42"})
+	_, _ = s.webhooks.Subscribe(webhook.Subscription{Client: "registry", Url: "http://localhost", Patients: []string{"42"}})
+	s.webhooks.Close()
+	evaluated = nil
+
+	n := consent.Notification{Domain: "Test", SignerIds: []consent.SignerId{{IdType: "gpas", Id: "psn-42"}}}
+	s.notifyWebhooks(n)
+	s.notifyWebhooks(n)
+
+	assert.Equal(t, []string{"42", "42"}, evaluated)
+	// resolved once when subscribing
+	assert.EqualValues(t, 1, r.calls.Load())
+}
@@ -0,0 +1,349 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNameClaim  = "preferred_username"
+	defaultRolesClaim = "roles"
+	// minimum time between refreshing the key set for unknown key ids
+	minRefreshInterval = time.Minute
+)
+
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// tokenValidator validates JWT bearer tokens issued by the configured OIDC
+// issuer.
+type tokenValidator struct {
+	issuer     string
+	audience   string
+	nameClaim  string
+	rolesClaim string
+	keys       *keySet
+}
+
+func newTokenValidator(c config.Oidc) (*tokenValidator, error) {
+	ttl := time.Hour
+	if c.CacheDuration != "" {
+		d, err := time.ParseDuration(c.CacheDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'app.http.oidc.cache-duration': %w", err)
+		}
+		ttl = d
+	}
+
+	v := &tokenValidator{
+		issuer:     c.Issuer,
+		audience:   c.Audience,
+		nameClaim:  c.NameClaim,
+		rolesClaim: c.RolesClaim,
+		keys: &keySet{
+			issuer: strings.TrimSuffix(c.Issuer, "/"),
+			url:    c.JwksUrl,
+			file:   c.JwksFile,
+			ttl:    ttl,
+		},
+	}
+	if v.nameClaim == "" {
+		v.nameClaim = defaultNameClaim
+	}
+	if v.rolesClaim == "" {
+		v.rolesClaim = defaultRolesClaim
+	}
+
+	return v, nil
+}
+
+func (v *tokenValidator) validate(token string) (*Principal, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithIssuer(v.issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods(signingMethods),
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, v.keyFunc, opts...); err != nil {
+		return nil, err
+	}
+
+	name, _ := claims[v.nameClaim].(string)
+	if name == "" {
+		name, _ = claims.GetSubject()
+	}
+
+	return &Principal{
+		Name:   name,
+		Roles:  parseRoles(claims, v.rolesClaim),
+		Claims: claims,
+		Bearer: true,
+	}, nil
+}
+
+func (v *tokenValidator) keyFunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	return v.keys.get(kid)
+}
+
+// parseRoles reads a list of roles from the claim. Nested claims can be
+// referenced with a dot separated path (e.g. 'realm_access.roles').
+func parseRoles(claims jwt.MapClaims, claim string) []string {
+	var value any = map[string]any(claims)
+	for _, p := range strings.Split(claim, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[p]
+	}
+
+	switch r := value.(type) {
+	case string:
+		return strings.Fields(r)
+	case []any:
+		roles := make([]string, 0, len(r))
+		for _, v := range r {
+			if s, ok := v.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+		return roles
+	}
+
+	return nil
+}
+
+// keySet caches the issuer's public keys. Keys are read from a JWKS file or
+// fetched from the JWKS endpoint, which is discovered from the issuer if not
+// configured.
+type keySet struct {
+	issuer string
+	url    string
+	file   string
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	keys    map[string]any
+	updated time.Time
+	// fetching allows a single refresh at a time, without blocking lookups
+	fetching sync.Mutex
+}
+
+func (k *keySet) get(kid string) (any, error) {
+	keys, updated := k.cached()
+
+	key, ok := lookup(keys, kid)
+	// refresh expired keys or on key rotation. Failed refreshes are not
+	// retried before minRefreshInterval either.
+	if time.Since(updated) > k.ttl || (!ok && time.Since(updated) > minRefreshInterval) {
+		keys = k.refresh(updated)
+		key, ok = lookup(keys, kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: '%s'", kid)
+	}
+
+	return key, nil
+}
+
+func (k *keySet) cached() (map[string]any, time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keys, k.updated
+}
+
+func lookup(keys map[string]any, kid string) (any, bool) {
+	if key, ok := keys[kid]; ok {
+		return key, true
+	}
+	// tokens without key id are accepted if there is only one key
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+// refresh loads the keys, unless another request refreshed them since they
+// were last updated at 'seen', and returns the current keys
+func (k *keySet) refresh(seen time.Time) map[string]any {
+	k.fetching.Lock()
+	defer k.fetching.Unlock()
+
+	if keys, updated := k.cached(); updated != seen {
+		return keys
+	}
+
+	keys, err := k.load()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.updated = time.Now()
+	if err != nil {
+		// keep using the cached keys, if any
+		log.Error().Err(err).Msg("Failed to load JWKS. Using cached keys")
+		return k.keys
+	}
+
+	k.keys = keys
+	log.Debug().Int("keys", len(keys)).Msg("Updated JWKS cache")
+	return keys
+}
+
+func (k *keySet) load() (map[string]any, error) {
+	var data []byte
+	var err error
+
+	if k.file != "" {
+		data, err = os.ReadFile(k.file)
+	} else {
+		if k.url == "" {
+			if k.url, err = discoverJwksUrl(k.issuer); err != nil {
+				return nil, err
+			}
+		}
+		data, err = fetch(k.url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJwks(data)
+}
+
+func discoverJwksUrl(issuer string) (string, error) {
+	data, err := fetch(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", err
+	}
+
+	var c struct {
+		JwksUri string `json:"jwks_uri"`
+	}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return "", err
+	}
+	if c.JwksUri == "" {
+		return "", errors.New("missing 'jwks_uri' in OpenID configuration")
+	}
+
+	return c.JwksUri, nil
+}
+
+func fetch(url string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request to %s failed with status %d", url, resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJwks(data []byte) (map[string]any, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]any)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warn().Err(err).Str("kid", k.Kid).Msg("Skipping invalid JWK")
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: '%s'", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type: '%s'", k.Kty)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
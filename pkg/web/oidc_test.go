@@ -0,0 +1,224 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://idp.local/realms/test"
+
+func TestValidateToken(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	file := path.Join(t.TempDir(), "jwks.json")
+	_ = os.WriteFile(file, testJwks(&key.PublicKey, "test-kid"), 0600)
+
+	v, _ := newTokenValidator(config.Oidc{
+		Issuer:     testIssuer,
+		Audience:   "consented",
+		JwksFile:   file,
+		RolesClaim: "realm_access.roles",
+	})
+
+	valid := jwt.MapClaims{
+		"iss":                testIssuer,
+		"aud":                "consented",
+		"sub":                "42",
+		"preferred_username": "portal-user",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"realm_access":       map[string]any{"roles": []string{"consent-read"}},
+	}
+
+	cases := []struct {
+		name     string
+		token    string
+		expected *Principal
+	}{
+		{
+			name:  "validToken",
+			token: sign(key, "test-kid", valid),
+			expected: &Principal{
+				Name:  "portal-user",
+				Roles: []string{"consent-read"},
+			},
+		},
+		{
+			name:  "wrongAudience",
+			token: sign(key, "test-kid", with(valid, "aud", "other")),
+		},
+		{
+			name:  "wrongIssuer",
+			token: sign(key, "test-kid", with(valid, "iss", "https://other.local")),
+		},
+		{
+			name:  "expired",
+			token: sign(key, "test-kid", with(valid, "exp", time.Now().Add(-time.Hour).Unix())),
+		},
+		{
+			name:  "missingExpiry",
+			token: sign(key, "test-kid", with(valid, "exp", nil)),
+		},
+		{
+			name:  "wrongKey",
+			token: sign(other, "test-kid", valid),
+		},
+		{
+			name:  "unknownKeyId",
+			token: sign(key, "unknown", valid),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := v.validate(c.token)
+
+			if c.expected == nil {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected.Name, actual.Name)
+			assert.Equal(t, c.expected.Roles, actual.Roles)
+		})
+	}
+}
+
+func TestValidateTokenWithDiscovery(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			_, _ = res.Write([]byte(`{"jwks_uri": "` + s.URL + `/certs"}`))
+		case "/certs":
+			_, _ = res.Write(testJwks(&key.PublicKey, "test-kid"))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	v, _ := newTokenValidator(config.Oidc{Issuer: s.URL})
+
+	actual, err := v.validate(sign(key, "test-kid", jwt.MapClaims{
+		"iss":   s.URL,
+		"sub":   "42",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": []string{"a", "b"},
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "42", actual.Name)
+	assert.Equal(t, []string{"a", "b"}, actual.Roles)
+}
+
+func TestKeySetUnavailable(t *testing.T) {
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	k := &keySet{url: s.URL, ttl: time.Hour}
+
+	// failed fetches are not retried before minRefreshInterval
+	for range 3 {
+		_, err := k.get("test-kid")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(1), requests.Load())
+
+	k.updated = k.updated.Add(-2 * minRefreshInterval)
+	_, _ = k.get("test-kid")
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	file := path.Join(t.TempDir(), "jwks.json")
+	_ = os.WriteFile(file, testJwks(&key.PublicKey, "test-kid"), 0600)
+
+	token := sign(key, "test-kid", jwt.MapClaims{
+		"iss": testIssuer,
+		"sub": "42",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	cases := []struct {
+		name   string
+		oidc   config.Oidc
+		status int
+	}{
+		{name: "enabled", oidc: config.Oidc{Issuer: testIssuer, JwksFile: file}, status: http.StatusOK},
+		{name: "disabled", status: http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, _ := newAuthenticator(config.Http{Oidc: c.oidc})
+
+			w := httptest.NewRecorder()
+			ctx, _ := ginTestContext(w)
+			ctx.Request.Header.Set("Authorization", "Bearer "+token)
+
+			a.middleware()(ctx)
+
+			assert.Equal(t, c.status, w.Code)
+			if c.status == http.StatusOK {
+				assert.Equal(t, "42", principal(ctx).Name)
+				assert.True(t, principal(ctx).Bearer)
+			}
+		})
+	}
+}
+
+func sign(key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["kid"] = kid
+	s, _ := t.SignedString(key)
+	return s
+}
+
+func with(claims jwt.MapClaims, key string, value any) jwt.MapClaims {
+	c := jwt.MapClaims{}
+	for k, v := range claims {
+		c[k] = v
+	}
+	if value == nil {
+		delete(c, key)
+	} else {
+		c[key] = value
+	}
+	return c
+}
+
+func testJwks(key *rsa.PublicKey, kid string) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kid": kid,
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	return b
+}
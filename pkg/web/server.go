@@ -1,13 +1,25 @@
 package web
 
 import (
+	"cmp"
+	"consented/pkg/audit"
 	"consented/pkg/config"
 	"consented/pkg/consent"
+	"consented/pkg/events"
+	"consented/pkg/identity"
+	"consented/pkg/webhook"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 	"net/http"
 	"os"
+	"os/signal"
 	"slices"
+	"syscall"
 	"time"
 )
 
@@ -15,21 +27,104 @@ type Server struct {
 	config      config.AppConfig
 	gicsClient  consent.GicsClient
 	domainCache *consent.DomainCache
+	auth        *authenticator
+	authz       *authorizer
+	auditor     *audit.Logger
+	limiter     *rateLimiter
+	// resolver translates patient ids to gICS signer ids (optional)
+	resolver identity.Resolver
+	// webhooks notifies subscribers about status changes (optional)
+	webhooks *webhook.Manager
+	// events fans out gICS notifications to internal subscribers
+	events *events.Bus[consent.Notification]
+	// signers indexes the signer ids of subscribed patients
+	signers *signerIndex
+	// clock and timezone consents are evaluated with
+	clock    consent.Clock
+	timezone *time.Location
 }
 
 func NewServer(config config.AppConfig) *Server {
-	c := consent.NewGicsClient(config)
+	var c consent.GicsClient = consent.NewGicsClient(config)
 	interval, err := time.ParseDuration(config.Gics.UpdateInterval)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not parse 'gics.update-interval' from app config")
 		os.Exit(1)
 	}
+	if max := config.Gics.MaxConcurrentRequests; max > 0 {
+		timeout, err := time.ParseDuration(config.Gics.QueueTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not parse 'gics.queue-timeout' from app config")
+			os.Exit(1)
+		}
+		c = consent.NewLimitedClient(c, max, timeout)
+	}
+	// defaults to one year
+	askConsentBefore := consent.Period{Years: 1}
+	if config.Gics.AskConsentBefore != "" {
+		askConsentBefore, err = consent.ParsePeriod(config.Gics.AskConsentBefore)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not parse 'gics.ask-consent-before' from app config")
+			os.Exit(1)
+		}
+	}
+	auth, err := newAuthenticator(config.App.Http)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not configure authentication from app config")
+		os.Exit(1)
+	}
+	authz, err := newAuthorizer(config.App.Authorization)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not configure authorization from app config")
+		os.Exit(1)
+	}
+	auditor, err := audit.NewLogger(config.Audit, config.App.Name)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not configure audit trail from app config")
+		os.Exit(1)
+	}
+	resolver, err := identity.NewResolver(config.Identity)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not configure identifier resolution from app config")
+		os.Exit(1)
+	}
+	// defaults to the local timezone
+	timezone := time.Local
+	if config.App.Timezone != "" {
+		timezone, err = time.LoadLocation(config.App.Timezone)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not parse 'app.timezone' from app config")
+			os.Exit(1)
+		}
+	}
 
-	return &Server{
+	s := &Server{
 		config:      config,
 		gicsClient:  c,
-		domainCache: consent.NewDomainCache(c, interval),
+		domainCache: consent.NewDomainCache(c, interval, consent.Defaults{AskConsentBefore: askConsentBefore}),
+		auth:        auth,
+		authz:       authz,
+		auditor:     auditor,
+		limiter:     newRateLimiter(config.App.Http.RateLimit),
+		resolver:    resolver,
+		signers:     newSignerIndex(),
+		clock:       consent.SystemClock{Location: timezone},
+		timezone:    timezone,
 	}
+	s.webhooks, err = webhook.NewManager(config.Webhooks, s.evaluateSubscription, s.auditDelivery)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not configure webhooks from app config")
+		os.Exit(1)
+	}
+	// defaults to four workers and a queue of 100 notifications
+	n := config.Gics.Notifications
+	s.events = events.NewBus[consent.Notification](cmp.Or(n.Workers, 4), cmp.Or(n.QueueSize, 100))
+	s.events.Subscribe(s.refreshDomains)
+	if s.webhooks != nil {
+		s.events.Subscribe(s.notifyWebhooks)
+	}
+
+	return s
 }
 
 func (s *Server) Run() error {
@@ -41,27 +136,72 @@ func (s *Server) Run() error {
 		log.Info().Str("path", v.Path).Str("method", v.Method).Msg("Route configured")
 	}
 
-	return r.Run(":" + s.config.App.Http.Port)
+	srv := &http.Server{Addr: ":" + s.config.App.Http.Port, Handler: r}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	failed := make(chan error, 1)
+	go func() { failed <- srv.ListenAndServe() }()
+	select {
+	case err := <-failed:
+		s.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	// finish running requests, then flush pending events
+	log.Info().Msg("Shutting down server")
+	timeout, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := srv.Shutdown(timeout)
+	s.Close()
+	return err
+}
+
+// Close handles queued notifications, then sends pending webhook events and
+// audit events
+func (s *Server) Close() {
+	s.events.Close()
+	s.webhooks.Close()
+	if err := s.auditor.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close audit trail")
+	}
 }
 
 func (s *Server) setupRouter() *gin.Engine {
 	r := gin.New()
+	// typed patient ids contain the (url encoded) identifier system
+	r.UseRawPath = true
 	_ = r.SetTrustedProxies(nil)
 	r.Use(config.DefaultStructuredLogger(), gin.Recovery())
 
-	r.POST("/consent/status/:pid", gin.BasicAuth(gin.Accounts{
-		s.config.App.Http.Auth.User: s.config.App.Http.Auth.Password,
-	}), s.handleConsentStatus)
+	auth := s.limiter.authenticate(s.auth.middleware())
+	limit := s.limiter.middleware()
+
+	r.POST("/consent/status/:pid", auth, limit, s.handleConsentStatus)
+	r.POST("/consent/permission/:pid", auth, limit, s.handlePermission)
+	r.GET("/consent/history/:pid/:domain", auth, limit, s.handleHistory)
+	r.POST("/consent/decision", auth, limit, s.handleDecision)
+	r.POST("/consent/withdraw/:pid/:domain", auth, limit, s.handleWithdraw)
+	if s.webhooks != nil {
+		r.POST("/subscriptions", auth, limit, s.handleSubscribe)
+		r.GET("/subscriptions", auth, limit, s.handleListSubscriptions)
+		r.DELETE("/subscriptions/:id", auth, limit, s.handleUnsubscribe)
+	}
+	if s.config.Gics.Notifications.Enabled {
+		r.POST("/gics/notification", auth, s.handleNotification)
+	}
 	r.GET("/health", s.checkHealth)
-	r.NoRoute(gin.BasicAuth(gin.Accounts{
-		s.config.App.Http.Auth.User: s.config.App.Http.Auth.Password,
-	}), func(c *gin.Context) {
+	r.GET("/metrics", auth, gin.WrapH(expvar.Handler()))
+	r.NoRoute(auth, func(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "404 page not found"})
 	})
 
 	return r
 }
 
+var errSignerIdSystem = errors.New("identifier system not accepted by domain")
+
 type StatusRequest struct {
 	PatientId   string   `uri:"pid" binding:"required"`
 	Departments []string `json:"departments"`
@@ -75,66 +215,396 @@ func (s *Server) handleConsentStatus(c *gin.Context) {
 	_ = c.ShouldBindUri(&r)
 	// body is optional
 	_ = c.ShouldBindJSON(&r)
+	pid, err := identity.ParseIdentifier(r.PatientId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	at, err := parseAt(c.Query("at"), s.timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	response := make([]consent.DomainStatus, 0)
-	// filter domains by department
-	for _, d := range s.filterDomains(r.Departments) {
+	// filter domains by department and authorization
+	allowed, denied := s.filterDomains(r.Departments, principal(c))
+	for _, d := range allowed {
 
 		// get status per domain
-		ds, err := s.createDomainStatus(r, d)
+		ds, err := s.createDomainStatus(pid, d, at)
+		if errors.Is(err, consent.ErrTooManyRequests) {
+			tooManyRequests(c, time.Second)
+			return
+		}
+		// patient id of another identifier system
+		if errors.Is(err, errSignerIdSystem) {
+			continue
+		}
 		if err != nil {
+			// report the domain, the evaluation failed for
+			response = append(response, failedStatus(d))
 			continue
 		}
 
 		response = append(response, *ds)
 	}
 
+	if s.authz.reportDenied() {
+		for _, d := range denied {
+			response = append(response, forbiddenStatus(d))
+		}
+	}
+
+	s.audit(c, r.PatientId, response)
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) audit(c *gin.Context, pid string, statuses []consent.DomainStatus) {
+	s.auditInteraction(c, audit.Search, pid, statuses)
+}
+
+func (s *Server) auditInteraction(c *gin.Context, interaction string, pid string, statuses []consent.DomainStatus) {
+	s.auditor.Log(audit.Event{
+		Interaction: interaction,
+		Client:      c.GetString(gin.AuthUserKey),
+		PatientId:   pid,
+		SourceIp:    c.ClientIP(),
+		Time:        s.clock.Now(),
+		Results:     auditResults(statuses),
+	})
+}
+
+// auditDelivery records the statuses sent to the subscribing client by webhook
+func (s *Server) auditDelivery(sub webhook.Subscription, pid string, delivered []consent.DomainStatus) {
+	s.auditor.Log(audit.Event{
+		Client:    sub.Client,
+		PatientId: pid,
+		Time:      s.clock.Now(),
+		Results:   auditResults(delivered),
+	})
+}
+
+func auditResults(statuses []consent.DomainStatus) []audit.Result {
+	results := make([]audit.Result, 0, len(statuses))
+	for _, ds := range statuses {
+		results = append(results, audit.Result{Domain: ds.Domain, Status: ds.Status.String()})
+	}
+	return results
+}
+
+func forbiddenStatus(d consent.Domain) consent.DomainStatus {
+	return emptyStatus(d, consent.Forbidden)
+}
+
+func failedStatus(d consent.Domain) consent.DomainStatus {
+	return emptyStatus(d, consent.Failed)
+}
+
+func emptyStatus(d consent.Domain, status consent.Status) consent.DomainStatus {
+	return consent.DomainStatus{
+		Domain:      d.Name,
+		Description: d.Description,
+		DocumentRef: d.DocumentRef,
+		Status:      status,
+		Policies:    make([]consent.Policy, 0),
+	}
+}
+
+type PermissionRequest struct {
+	PatientId   string   `uri:"pid" binding:"required"`
+	Policies    []string `json:"policies" binding:"required,min=1"`
+	Domains     []string `json:"domains"`
+	Departments []string `json:"departments"`
+}
+
+func (s *Server) handlePermission(c *gin.Context) {
+
+	// bind to struct
+	var r PermissionRequest
+	// path parameter is matched by route
+	_ = c.ShouldBindUri(&r)
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pid, err := identity.ParseIdentifier(r.PatientId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	at, err := parseAt(c.Query("at"), s.timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	statuses := make([]consent.DomainStatus, 0)
+	// domains, which could not be evaluated
+	var failed []consent.Domain
+	// filter domains by department and authorization
+	allowed, _ := s.filterDomains(r.Departments, principal(c))
+	for _, d := range allowed {
+		// optionally restricted to domains
+		if len(r.Domains) > 0 && !slices.Contains(r.Domains, d.Name) {
+			continue
+		}
+
+		ds, err := s.createDomainStatus(pid, d, at)
+		if errors.Is(err, consent.ErrTooManyRequests) {
+			tooManyRequests(c, time.Second)
+			return
+		}
+		// the domain can't decide for typed ids of other systems
+		if errors.Is(err, errSignerIdSystem) {
+			continue
+		}
+		if err != nil {
+			failed = append(failed, d)
+			continue
+		}
+
+		statuses = append(statuses, *ds)
+	}
+
+	now := s.evaluationClock(at).Now()
+	response := make([]consent.Permission, 0, len(r.Policies))
+	for _, p := range r.Policies {
+		response = append(response, consent.CheckPermission(p, statuses, failed, now))
+	}
+
+	s.audit(c, r.PatientId, statuses)
 	c.JSON(http.StatusOK, response)
 }
 
+type HistoryRequest struct {
+	PatientId string `uri:"pid" binding:"required"`
+	Domain    string `uri:"domain" binding:"required"`
+}
+
+func (s *Server) handleHistory(c *gin.Context) {
+
+	// bind to struct
+	var r HistoryRequest
+	// path parameters are matched by route
+	_ = c.ShouldBindUri(&r)
+	pid, err := identity.ParseIdentifier(r.PatientId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	d, ok := s.findDomain(r.Domain)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "domain not found"})
+		return
+	}
+
+	// check authorization
+	if !s.authz.isAllowed(principal(c), d) {
+		if s.authz.reportDenied() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "access to domain denied"})
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"error": "domain not found"})
+		}
+		return
+	}
+
+	signerId, ok := s.requireSignerId(c, pid, d)
+	if !ok {
+		return
+	}
+
+	resp, err := s.gicsClient.GetConsents(signerId, d)
+	if errors.Is(err, consent.ErrTooManyRequests) {
+		tooManyRequests(c, time.Second)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get consents from gICS")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to get consents from gICS"})
+		return
+	}
+
+	history, err := consent.ParseHistory(resp, d, s.gicsClient, s.clock)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to parse consent history from gICS")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "unable to parse consent history"})
+		return
+	}
+
+	// latest status
+	status := consent.NotAsked
+	if len(history) > 0 {
+		status = history[len(history)-1].Status
+	}
+	s.audit(c, r.PatientId, []consent.DomainStatus{{Domain: d.Name, Status: status}})
+	c.JSON(http.StatusOK, history)
+}
+
 func (s *Server) Init() {
 	s.domainCache.Initialize()
+	s.reindexSigners()
+	s.webhooks.Start()
+}
+
+// findDomain returns the cached domain by name
+func (s *Server) findDomain(name string) (consent.Domain, bool) {
+	domains := s.domainCache.List()
+	i := slices.IndexFunc(domains, func(d consent.Domain) bool { return d.Name == name })
+	if i < 0 {
+		return consent.Domain{}, false
+	}
+	return domains[i], true
 }
 
-func (s *Server) filterDomains(deps []string) []consent.Domain {
-	var domains []consent.Domain
-	for _, d := range s.domainCache.Domains {
-		// no restrictions
-		if len(d.Departments) > 0 {
-			for _, required := range d.Departments {
-				if slices.Contains(deps, required) {
-					domains = append(domains, d)
-					break
-				}
-			}
+// filterDomains returns the domains matching the requested departments,
+// split by whether the client is allowed to access them or not.
+func (s *Server) filterDomains(deps []string, p *Principal) (allowed []consent.Domain, denied []consent.Domain) {
+	for _, d := range s.domainCache.List() {
+		if !matchesDepartments(d, deps) {
 			continue
 		}
-		domains = append(domains, d)
+
+		if s.authz.isAllowed(p, d) {
+			allowed = append(allowed, d)
+		} else {
+			denied = append(denied, d)
+		}
 	}
 
-	return domains
+	return allowed, denied
 }
 
-func (s *Server) createDomainStatus(r StatusRequest, d consent.Domain) (*consent.DomainStatus, error) {
-	// get current policies
-	resp, err := s.gicsClient.GetConsentPolicies(r.PatientId, d)
+func matchesDepartments(d consent.Domain, deps []string) bool {
+	// no restrictions
+	if len(d.Departments) == 0 {
+		return true
+	}
+
+	for _, required := range d.Departments {
+		if slices.Contains(deps, required) {
+			return true
+		}
+	}
+	return false
+}
+
+// createDomainStatus evaluates the consent status of the domain. If at is set,
+// the status is evaluated for that point in time instead of now.
+func (s *Server) createDomainStatus(pid identity.Identifier, d consent.Domain, at *time.Time) (*consent.DomainStatus, error) {
+	signerId, reported, err := s.resolveSignerId(pid, d)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *fhir.Bundle
+	if at == nil {
+		// get current policies
+		resp, err = s.gicsClient.GetConsentPolicies(signerId, d)
+	} else {
+		// get historic policies
+		resp, err = s.gicsClient.GetConsentPoliciesAt(signerId, d, *at)
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get consent status from gICS")
 		return nil, err
 	}
 
 	// parse resources
-	ds, err := consent.ParseConsent(resp, d, s.gicsClient)
+	ds, err := consent.ParseConsent(resp, d, s.gicsClient, s.evaluationClock(at))
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to parse consent policies from gICS")
 		return nil, err
 	}
+	if reported {
+		ds.SignerId = &signerId
+	}
 
 	return ds, nil
 }
 
+// requireSignerId resolves the signer id of the patient in the domain.
+// Otherwise, the error response is sent.
+func (s *Server) requireSignerId(c *gin.Context, pid identity.Identifier, d consent.Domain) (identity.Identifier, bool) {
+	signerId, _, err := s.resolveSignerId(pid, d)
+	if errors.Is(err, errSignerIdSystem) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return signerId, false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to resolve patient identifier"})
+		return signerId, false
+	}
+	return signerId, true
+}
+
+// resolveSignerId returns the identifier of the patient as gICS signer of the
+// domain and whether it is reported in the domain status (typed or resolved
+// ids). A typed patient id of one of the domain's signer id systems is used as
+// is. Otherwise, bare patient ids and those of the resolver's source system
+// are resolved, if a resolver is configured for the domain. The resolved id
+// keeps its system, if the domain accepts it, and defaults to the domain's
+// primary system without one. Bare patient ids default to the domain's
+// primary system.
+func (s *Server) resolveSignerId(pid identity.Identifier, d consent.Domain) (identity.Identifier, bool, error) {
+	if pid.System != "" && d.AcceptsSignerIdSystem(pid.System) {
+		return pid, true, nil
+	}
+
+	resolvable := pid.System == "" || pid.System == s.config.Identity.SourceSystem
+	if system := s.config.Identity.System; s.resolver != nil && resolvable && (system == "" || d.AcceptsSignerIdSystem(system)) {
+		id, err := s.resolver.Resolve(pid.Value)
+		if err != nil {
+			log.Error().Err(err).Str("domain", d.Name).Msg("Failed to resolve patient identifier")
+			return identity.Identifier{}, false, err
+		}
+		// the resolver returns the configured system, if any
+		switch {
+		case id.System == "":
+			return identity.Identifier{System: d.PersonIdSystem, Value: id.Value}, true, nil
+		case d.AcceptsSignerIdSystem(id.System):
+			return identity.Identifier{System: id.System, Value: id.Value}, true, nil
+		}
+	}
+
+	if pid.System == "" {
+		return identity.Identifier{System: d.PersonIdSystem, Value: pid.Value}, false, nil
+	}
+	return identity.Identifier{}, false, errSignerIdSystem
+}
+
+// evaluationClock returns the server's clock or a fixed one, if the status is
+// evaluated at a given point in time
+func (s *Server) evaluationClock(at *time.Time) consent.Clock {
+	if at != nil {
+		return consent.FixedClock(*at)
+	}
+	return s.clock
+}
+
+// parseAt parses the optional evaluation time, either as RFC 3339 date-time or
+// as full date (midnight in the evaluation timezone)
+func parseAt(s string, loc *time.Location) (*time.Time, error) {
+	return parseDateParam("at", s, loc)
+}
+
+func parseDateParam(name string, s string, loc *time.Location) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, loc); err == nil {
+		return &t, nil
+	}
+
+	return nil, fmt.Errorf("invalid '%s' parameter: '%s'. Expected RFC 3339 date or date-time", name, s)
+}
+
 func (s *Server) checkHealth(c *gin.Context) {
-	if s.domainCache.IsHealthy {
+	if s.domainCache.Healthy() {
 		c.JSON(http.StatusOK, gin.H{
 			"healthy": true,
 		})
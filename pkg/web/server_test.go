@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"consented/pkg/config"
 	"consented/pkg/consent"
+	"consented/pkg/identity"
+	"consented/pkg/webhook"
+	"errors"
 	"github.com/kinbiko/jsonassert"
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -23,6 +28,12 @@ type HandlerTestCase struct {
 	responseStatus int
 	response       string
 	healthy        bool
+	authorization  *config.Authorization
+	checkPolicy    string
+	withdrawalUri  string
+	resolver       identity.Resolver
+	webhooks       bool
+	notifications  []string
 }
 
 type FilterDomainTestCase struct {
@@ -55,12 +66,94 @@ func TestHandleConsentStatus(t *testing.T) {
 			},
 			responseStatus: 401,
 		},
+		{
+			name:           "handlerForbidden",
+			requestUrl:     "/consent/status/42",
+			Auth:           testAuth,
+			authorization:  &config.Authorization{Denied: "forbidden", Rules: []config.Rule{{Clients: []string{"other"}, Domains: []string{"*"}}}},
+			responseStatus: 200,
+			response:       `[{"domain":"Test","description":"Test Consent","document-ref":null,"status":"forbidden","last-updated":null,"ask-consent": false,"policies":[]}]`,
+		},
+		{
+			name:           "handlerOmitted",
+			requestUrl:     "/consent/status/42",
+			Auth:           testAuth,
+			authorization:  &config.Authorization{Rules: []config.Rule{{Clients: []string{"other"}, Domains: []string{"*"}}}},
+			responseStatus: 200,
+			response:       `[]`,
+		},
 		{
 			name:           "handlerSuccess",
 			requestUrl:     "/consent/status/42",
 			Auth:           testAuth,
 			responseStatus: 200,
-			response:       `[{"domain":"Test","description":"Test Consent","document-ref":null,"status":"accepted","last-updated":"<<PRESENCE>>","ask-consent": false,"policies":[{"name": "IDAT_TEST","permit": true}]}]`,
+			response:       `[{"domain":"Test","description":"Test Consent","document-ref":null,"status":"accepted","last-updated":"<<PRESENCE>>","ask-consent": false,"ask-consent-reason":"consented","policies":[{"name": "IDAT_TEST","permit": true,"code":"IDAT_TEST","system":"https://ths-greifswald.de/fhir/CodeSystem/gics/Policy/Test","period":{"start":"<<PRESENCE>>","end":"<<PRESENCE>>"},"expired":false}]}]`,
+		},
+		{
+			name:           "handlerFailed",
+			requestUrl:     "/consent/status/42",
+			Auth:           testAuth,
+			checkPolicy:    "IDAT_TEST AND (",
+			responseStatus: 200,
+			response:       `[{"domain":"Test","description":"Test Consent","document-ref":null,"status":"failed","last-updated":null,"ask-consent": false,"policies":[]}]`,
+		},
+		{
+			name:           "handlerResolvedSignerId",
+			requestUrl:     "/consent/status/42",
+			Auth:           testAuth,
+			resolver:       &testResolver{system: of("")},
+			responseStatus: 200,
+			response:       `[{"domain":"Test","description":"Test Consent","document-ref":null,"status":"accepted","last-updated":"<<PRESENCE>>","ask-consent": false,"ask-consent-reason":"consented","policies":"<<PRESENCE>>","signer-id":{"system":"https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID","value":"psn-42"}}]`,
+		},
+		{
+			name:           "handlerResolutionFailed",
+			requestUrl:     "/consent/status/42",
+			Auth:           testAuth,
+			resolver:       &testResolver{err: errors.New("gPAS unavailable")},
+			responseStatus: 200,
+			response:       `[{"domain":"Test","description":"Test Consent","document-ref":null,"status":"failed","last-updated":null,"ask-consent": false,"policies":[]}]`,
+		},
+		{
+			name:           "handlerTypedPid",
+			requestUrl:     "/consent/status/" + url.PathEscape("https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID|42"),
+			Auth:           testAuth,
+			responseStatus: 200,
+			response:       `[{"domain":"Test","description":"Test Consent","document-ref":null,"status":"accepted","last-updated":"<<PRESENCE>>","ask-consent": false,"ask-consent-reason":"consented","policies":"<<PRESENCE>>","signer-id":{"system":"https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID","value":"42"}}]`,
+		},
+		{
+			name:           "handlerTypedPidOtherSystem",
+			requestUrl:     "/consent/status/" + url.PathEscape("https://example.org/kis|42"),
+			Auth:           testAuth,
+			responseStatus: 200,
+			response:       `[]`,
+		},
+		{
+			name:           "handlerTypedPidMissingValue",
+			requestUrl:     "/consent/status/" + url.PathEscape("https://example.org/kis|"),
+			Auth:           testAuth,
+			responseStatus: 400,
+			response:       `{"error":"invalid patient identifier: 'https://example.org/kis|'. Expected 'value' or 'system|value'"}`,
+		},
+		{
+			name:           "handlerAtBeforeConsent",
+			requestUrl:     "/consent/status/42?at=2020-01-01",
+			Auth:           testAuth,
+			responseStatus: 200,
+			response:       `[{"domain":"Test","description":"Test Consent","document-ref":null,"status":"not-asked","last-updated":null,"ask-consent": true,"ask-consent-reason":"not-asked","policies":[]}]`,
+		},
+		{
+			name:           "handlerAtAfterExpiry",
+			requestUrl:     "/consent/status/42?at=" + time.Now().UTC().AddDate(10, 0, 0).Format(time.RFC3339),
+			Auth:           testAuth,
+			responseStatus: 200,
+			response:       `[{"domain":"Test","description":"Test Consent","document-ref":null,"status":"expired","last-updated":"<<PRESENCE>>","ask-consent": true,"ask-consent-reason":"expired","policies":[{"name": "IDAT_TEST","permit": true,"code":"IDAT_TEST","system":"https://ths-greifswald.de/fhir/CodeSystem/gics/Policy/Test","period":{"start":"<<PRESENCE>>","end":"<<PRESENCE>>"},"expired":true}]}]`,
+		},
+		{
+			name:           "handlerAtInvalid",
+			requestUrl:     "/consent/status/42?at=yesterday",
+			Auth:           testAuth,
+			responseStatus: 400,
+			response:       `{"error":"invalid 'at' parameter: 'yesterday'. Expected RFC 3339 date or date-time"}`,
 		},
 	}
 
@@ -71,6 +164,178 @@ func TestHandleConsentStatus(t *testing.T) {
 	}
 }
 
+func TestHandlePermission(t *testing.T) {
+
+	cases := []HandlerTestCase{
+		{
+			name:           "permissionMissingPolicies",
+			requestUrl:     "/consent/permission/42",
+			Auth:           testAuth,
+			body:           `{"domains": ["Test"]}`,
+			responseStatus: 400,
+		},
+		{
+			name:           "permissionPermitted",
+			requestUrl:     "/consent/permission/42",
+			Auth:           testAuth,
+			body:           `{"policies": ["IDAT_TEST", "MDAT_TEST"]}`,
+			responseStatus: 200,
+			response:       `[{"policy":"IDAT_TEST","permitted":true,"domain":"Test","consent-date":"<<PRESENCE>>","expires":"<<PRESENCE>>"},{"policy":"MDAT_TEST","permitted":false,"domain":null,"consent-date":null,"expires":null}]`,
+		},
+		{
+			name:           "permissionOtherDomain",
+			requestUrl:     "/consent/permission/42",
+			Auth:           testAuth,
+			body:           `{"policies": ["IDAT_TEST"], "domains": ["Other"]}`,
+			responseStatus: 200,
+			response:       `[{"policy":"IDAT_TEST","permitted":false,"domain":null,"consent-date":null,"expires":null}]`,
+		},
+		{
+			name:           "permissionResolutionFailed",
+			requestUrl:     "/consent/permission/42",
+			Auth:           testAuth,
+			resolver:       &testResolver{err: errors.New("gPAS unavailable")},
+			body:           `{"policies": ["IDAT_TEST"]}`,
+			responseStatus: 200,
+			response:       `[{"policy":"IDAT_TEST","permitted":false,"domain":null,"consent-date":null,"expires":null,"failed-domains":["Test"]}]`,
+		},
+		{
+			name:           "permissionAtBeforeConsent",
+			requestUrl:     "/consent/permission/42?at=2020-01-01T00:00:00Z",
+			Auth:           testAuth,
+			body:           `{"policies": ["IDAT_TEST"]}`,
+			responseStatus: 200,
+			response:       `[{"policy":"IDAT_TEST","permitted":false,"domain":null,"consent-date":null,"expires":null}]`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handler(t, c)
+		})
+	}
+}
+
+func TestHandleHistory(t *testing.T) {
+
+	cases := []HandlerTestCase{
+		{
+			name:           "historySuccess",
+			method:         http.MethodGet,
+			requestUrl:     "/consent/history/42/Test",
+			Auth:           testAuth,
+			responseStatus: 200,
+			response:       `[{"date":"<<PRESENCE>>","source-reference":null,"template":null,"event":"signed","status":"accepted","policies":[{"name": "IDAT_TEST","permit": true,"code":"IDAT_TEST","system":"https://ths-greifswald.de/fhir/CodeSystem/gics/Policy/Test","period":{"start":"<<PRESENCE>>","end":"<<PRESENCE>>"},"expired":false}]}]`,
+		},
+		{
+			name:           "historyUnknownDomain",
+			method:         http.MethodGet,
+			requestUrl:     "/consent/history/42/Other",
+			Auth:           testAuth,
+			responseStatus: 404,
+			response:       `{"error":"domain not found"}`,
+		},
+		{
+			name:           "historyForbidden",
+			method:         http.MethodGet,
+			requestUrl:     "/consent/history/42/Test",
+			Auth:           testAuth,
+			authorization:  &config.Authorization{Denied: "forbidden", Rules: []config.Rule{{Clients: []string{"other"}, Domains: []string{"*"}}}},
+			responseStatus: 403,
+			response:       `{"error":"access to domain denied"}`,
+		},
+		{
+			name:           "historyOmitted",
+			method:         http.MethodGet,
+			requestUrl:     "/consent/history/42/Test",
+			Auth:           testAuth,
+			authorization:  &config.Authorization{Rules: []config.Rule{{Clients: []string{"other"}, Domains: []string{"*"}}}},
+			responseStatus: 404,
+			response:       `{"error":"domain not found"}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handler(t, c)
+		})
+	}
+}
+
+func TestResolveSignerId(t *testing.T) {
+	d := consent.Domain{
+		Name:            "Test",
+		PersonIdSystem:  "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID",
+		PersonIdSystems: []string{"https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID", "https://ths-greifswald.de/gpas"},
+	}
+	bare := identity.Identifier{Value: "42"}
+
+	cases := []struct {
+		name     string
+		pid      identity.Identifier
+		resolver identity.Resolver
+		system   string
+		expected identity.Identifier
+		reported bool
+		err      error
+	}{
+		{"bare", bare, nil, "", identity.Identifier{System: d.PersonIdSystem, Value: "42"}, false, nil},
+		{"typedPrimary", identity.Identifier{System: d.PersonIdSystem, Value: "42"}, nil, "", identity.Identifier{System: d.PersonIdSystem, Value: "42"}, true, nil},
+		{"typedSecondary", identity.Identifier{System: "https://ths-greifswald.de/gpas", Value: "psn-42"}, &testResolver{}, "", identity.Identifier{System: "https://ths-greifswald.de/gpas", Value: "psn-42"}, true, nil},
+		{"typedOtherSystem", identity.Identifier{System: "https://example.org/kis", Value: "42"}, nil, "", identity.Identifier{}, false, errSignerIdSystem},
+		{"resolvedAllDomains", bare, &testResolver{}, "", identity.Identifier{System: "https://ths-greifswald.de/gpas", Value: "psn-42"}, true, nil},
+		{"resolvedWithoutSystem", bare, &testResolver{system: of("")}, "", identity.Identifier{System: d.PersonIdSystem, Value: "psn-42"}, true, nil},
+		{"resolvedSystemNotAccepted", bare, &testResolver{system: of("https://ths-greifswald.de/epix")}, "", identity.Identifier{System: d.PersonIdSystem, Value: "42"}, false, nil},
+		{"resolvedMatchingSystem", bare, &testResolver{}, "https://ths-greifswald.de/gpas", identity.Identifier{System: "https://ths-greifswald.de/gpas", Value: "psn-42"}, true, nil},
+		{"resolvedTyped", identity.Identifier{System: "https://example.org/kis", Value: "42"}, &testResolver{}, "https://ths-greifswald.de/gpas", identity.Identifier{System: "https://ths-greifswald.de/gpas", Value: "psn-42"}, true, nil},
+		{"resolverTypedOtherSystem", identity.Identifier{System: "https://example.org/other", Value: "42"}, &testResolver{}, "https://ths-greifswald.de/gpas", identity.Identifier{}, false, errSignerIdSystem},
+		{"resolverOtherSystem", bare, &testResolver{}, "https://ths-greifswald.de/epix", identity.Identifier{System: d.PersonIdSystem, Value: "42"}, false, nil},
+		{"resolutionFailed", bare, &testResolver{err: errors.New("gPAS unavailable")}, "", identity.Identifier{}, false, errors.New("gPAS unavailable")},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Server{resolver: c.resolver, config: config.AppConfig{Identity: config.Identity{System: c.system, SourceSystem: "https://example.org/kis"}}}
+
+			signerId, reported, err := s.resolveSignerId(c.pid, d)
+
+			assert.Equal(t, c.err, err)
+			assert.Equal(t, c.expected, signerId)
+			assert.Equal(t, c.reported, reported)
+		})
+	}
+}
+
+func TestParseAt(t *testing.T) {
+	cet := time.FixedZone("CET", 3600)
+
+	cases := []struct {
+		name     string
+		at       string
+		expected *time.Time
+		error    bool
+	}{
+		{"empty", "", nil, false},
+		{"dateTime", "2023-06-01T12:00:00Z", of(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)), false},
+		{"dateTimeWithOffset", "2023-06-01T12:00:00+02:00", of(time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)), false},
+		{"dateInEvaluationTimezone", "2023-06-01", of(time.Date(2023, 6, 1, 0, 0, 0, 0, cet)), false},
+		{"invalid", "2023-06", nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := parseAt(c.at, cet)
+
+			assert.Equal(t, c.error, err != nil)
+			if c.expected == nil {
+				assert.Nil(t, actual)
+			} else {
+				assert.True(t, c.expected.Equal(*actual), "expected %v, got %v", c.expected, actual)
+			}
+		})
+	}
+}
+
 func handler(t *testing.T, data HandlerTestCase) {
 	// setup config
 	c := config.AppConfig{
@@ -91,14 +356,34 @@ func handler(t *testing.T, data HandlerTestCase) {
 			Description:     "Test Consent",
 			CheckPolicyCode: "IDAT_TEST",
 			PersonIdSystem:  "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID",
+			WithdrawalUri:   "Widerruf",
 		},
 		},
 		Initialized: true,
 	}
 	s.gicsClient = &TestGicsClient{}
 	s.config.App.Http.Auth = testAuth
+	s.resolver = data.resolver
+	if data.checkPolicy != "" {
+		s.domainCache.Domains[0].CheckPolicyCode = data.checkPolicy
+	}
+	if data.withdrawalUri != "" {
+		s.domainCache.Domains[0].WithdrawalUri = data.withdrawalUri
+	}
+	if data.authorization != nil {
+		s.authz, _ = newAuthorizer(*data.authorization)
+	}
 
-	data.method = http.MethodPost
+	if data.notifications != nil {
+		s.config.Gics.Notifications = config.Notifications{Enabled: true, Clients: data.notifications}
+	}
+	if data.webhooks {
+		s.webhooks, _ = webhook.NewManager(config.Webhooks{Enabled: true}, s.evaluateSubscription, nil)
+	}
+
+	if data.method == "" {
+		data.method = http.MethodPost
+	}
 
 	testRoute(t, s, data)
 }
@@ -120,7 +405,7 @@ func TestFilterDomains(t *testing.T) {
 	}
 
 	s := &Server{}
-	s.domainCache = consent.NewDomainCache(nil, -1)
+	s.domainCache = consent.NewDomainCache(nil, -1, consent.Defaults{})
 	s.domainCache.Domains = []consent.Domain{test, dep}
 
 	for _, c := range []FilterDomainTestCase{
@@ -137,16 +422,87 @@ func TestFilterDomains(t *testing.T) {
 		t.Run(c.name, func(t *testing.T) {
 
 			// act
-			filtered := s.filterDomains(c.filter)
+			filtered, _ := s.filterDomains(c.filter, nil)
 			assert.Equal(t, c.result, filtered)
 		})
 	}
 
-	filtered := s.filterDomains([]string{})
+	filtered, _ := s.filterDomains([]string{}, nil)
 
 	assert.Equal(t, []consent.Domain{test}, filtered)
 }
 
+func TestFilterDomainsAuthorized(t *testing.T) {
+	test := consent.Domain{Name: "Test"}
+	dep := consent.Domain{Name: "Dep", Departments: []string{"dep"}}
+	other := consent.Domain{Name: "Other"}
+
+	s := &Server{}
+	s.domainCache = consent.NewDomainCache(nil, -1, consent.Defaults{})
+	s.domainCache.Domains = []consent.Domain{test, dep, other}
+	s.authz, _ = newAuthorizer(config.Authorization{Rules: []config.Rule{
+		{Clients: []string{"registry"}, Domains: []string{"Test"}},
+		{Roles: []string{"dep-role"}, Departments: []string{"dep"}},
+		{Clients: []string{"admin"}, Domains: []string{"*"}},
+	}})
+
+	cases := []struct {
+		name      string
+		principal *Principal
+		allowed   []consent.Domain
+		denied    []consent.Domain
+	}{
+		{
+			name:      "byClient",
+			principal: &Principal{Name: "registry"},
+			allowed:   []consent.Domain{test},
+			denied:    []consent.Domain{dep, other},
+		},
+		{
+			name:      "byRoleAndDepartment",
+			principal: &Principal{Name: "portal-user", Roles: []string{"dep-role"}},
+			allowed:   []consent.Domain{dep},
+			denied:    []consent.Domain{test, other},
+		},
+		{
+			name:      "wildcard",
+			principal: &Principal{Name: "admin"},
+			allowed:   []consent.Domain{test, dep, other},
+		},
+		{
+			name:      "tokenByRole",
+			principal: &Principal{Name: "portal-user", Roles: []string{"dep-role"}, Bearer: true},
+			allowed:   []consent.Domain{dep},
+			denied:    []consent.Domain{test, other},
+		},
+		{
+			name:      "tokenNamedAfterClient",
+			principal: &Principal{Name: "admin", Bearer: true},
+			denied:    []consent.Domain{test, dep, other},
+		},
+		{
+			name:      "noMatchingRule",
+			principal: &Principal{Name: "unknown"},
+			denied:    []consent.Domain{test, dep, other},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			allowed, denied := s.filterDomains([]string{"dep"}, c.principal)
+
+			assert.Equal(t, c.allowed, allowed)
+			assert.Equal(t, c.denied, denied)
+		})
+	}
+}
+
+func TestNewAuthorizerInvalidMode(t *testing.T) {
+	_, err := newAuthorizer(config.Authorization{Denied: "hide"})
+
+	assert.Error(t, err)
+}
+
 func TestServerRun(t *testing.T) {
 	c := config.AppConfig{
 		App:  config.App{Http: config.Http{Port: "-1", Auth: testAuth}},
@@ -163,11 +519,30 @@ func TestServerRun(t *testing.T) {
 
 type TestGicsClient struct{}
 
+type testResolver struct {
+	err error
+	// system of the resolved ids (nil: gPAS)
+	system *string
+	calls  atomic.Int32
+}
+
+func (r *testResolver) Resolve(pid string) (*identity.Identifier, error) {
+	r.calls.Add(1)
+	if r.err != nil {
+		return nil, r.err
+	}
+	system := "https://ths-greifswald.de/gpas"
+	if r.system != nil {
+		system = *r.system
+	}
+	return &identity.Identifier{System: system, Value: "psn-" + pid}, nil
+}
+
 func (c *TestGicsClient) GetDomains() ([]fhir.ResearchStudy, error) {
 	return []fhir.ResearchStudy{}, nil
 }
 
-func (c *TestGicsClient) GetConsentPolicies(_ string, domain consent.Domain) (*fhir.Bundle, error) {
+func (c *TestGicsClient) GetConsentPolicies(_ identity.Identifier, domain consent.Domain) (*fhir.Bundle, error) {
 	startTime := of(time.Now().Format(time.RFC3339))
 	r := fhir.Consent{
 		DateTime: startTime,
@@ -197,14 +572,57 @@ func (c *TestGicsClient) GetConsentPolicies(_ string, domain consent.Domain) (*f
 	}, nil
 }
 
+func (c *TestGicsClient) GetConsentPoliciesAt(pid identity.Identifier, domain consent.Domain, at time.Time) (*fhir.Bundle, error) {
+	// consent is given now
+	if at.Before(time.Now().Add(-time.Minute)) {
+		return &fhir.Bundle{}, nil
+	}
+	return c.GetConsentPolicies(pid, domain)
+}
+
+func (c *TestGicsClient) GetConsents(pid identity.Identifier, domain consent.Domain) (*fhir.Bundle, error) {
+	return c.GetConsentPolicies(pid, domain)
+}
+
 func (c *TestGicsClient) GetTemplate(_ string, _ string) string {
 	return ""
 }
 
+func (c *TestGicsClient) GetQuestionnaires(_ string) ([]fhir.Questionnaire, error) {
+	return []fhir.Questionnaire{{
+		Url:     of("https://ths-greifswald.de/fhir/gics/Questionnaire/Test"),
+		Version: of("1.0"),
+		Name:    of("Test"),
+		Item: []fhir.QuestionnaireItem{{
+			LinkId: "1",
+			Code:   []fhir.Coding{{System: of("https://ths-greifswald.de/fhir/CodeSystem/gics/Policy/Test"), Code: of("IDAT_TEST")}},
+		}},
+	}, {
+		Url:     of("https://ths-greifswald.de/fhir/gics/Questionnaire/Widerruf"),
+		Version: of("1.0"),
+		Name:    of("Widerruf"),
+		Code:    []fhir.Coding{{System: of(consent.TemplateType), Code: of("WITHDRAWAL")}},
+		Item: []fhir.QuestionnaireItem{{
+			LinkId: "1",
+			Code:   []fhir.Coding{{System: of("https://ths-greifswald.de/fhir/CodeSystem/gics/Policy/Test"), Code: of("IDAT_TEST")}},
+		}},
+	}, {
+		// withdrawal template without policies
+		Url:     of("https://ths-greifswald.de/fhir/gics/Questionnaire/Leer"),
+		Version: of("1.0"),
+		Name:    of("Leer"),
+		Code:    []fhir.Coding{{System: of(consent.TemplateType), Code: of("WITHDRAWAL")}},
+	}}, nil
+}
+
 func (c *TestGicsClient) GetSourceReferenceTemplate(_ string) string {
 	return ""
 }
 
+func (c *TestGicsClient) AddConsent(_ consent.Domain, _ *fhir.Bundle) error {
+	return nil
+}
+
 func TestCheckHealth(t *testing.T) {
 	cases := []HandlerTestCase{
 		{
@@ -239,7 +657,8 @@ func checkHealth(t *testing.T, data HandlerTestCase) {
 		},
 	}
 
-	s := &Server{config: c, domainCache: &consent.DomainCache{IsHealthy: data.healthy}}
+	auth, _ := newAuthenticator(c.App.Http)
+	s := &Server{config: c, domainCache: &consent.DomainCache{IsHealthy: data.healthy}, auth: auth}
 	data.method = http.MethodGet
 	data.requestUrl = "/health"
 
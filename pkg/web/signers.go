@@ -0,0 +1,91 @@
+package web
+
+import (
+	"consented/pkg/identity"
+	"slices"
+	"sync"
+)
+
+// signerIndex maps the signer ids of subscribed patients per domain to their
+// patient ids, so notifications don't need to resolve all watched patients
+type signerIndex struct {
+	mu      sync.RWMutex
+	entries map[signerKey][]signerEntry
+}
+
+type signerKey struct {
+	domain string
+	value  string
+}
+
+type signerEntry struct {
+	system string
+	pid    string
+}
+
+func newSignerIndex() *signerIndex {
+	return &signerIndex{entries: make(map[signerKey][]signerEntry)}
+}
+
+// add records the patient's signer id in the domain
+func (x *signerIndex) add(domain string, id identity.Identifier, pid string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	k := signerKey{domain: domain, value: id.Value}
+	e := signerEntry{system: id.System, pid: pid}
+	if !slices.Contains(x.entries[k], e) {
+		x.entries[k] = append(x.entries[k], e)
+	}
+}
+
+// replace swaps the entries with the ones of the rebuilt index
+func (x *signerIndex) replace(rebuilt *signerIndex) {
+	rebuilt.mu.RLock()
+	defer rebuilt.mu.RUnlock()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries = rebuilt.entries
+}
+
+// lookup returns the patient ids with one of the signer ids in the domain.
+// Signer ids without system match all systems.
+func (x *signerIndex) lookup(domain string, ids []identity.Identifier) map[string]bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	result := make(map[string]bool)
+	for _, id := range ids {
+		for _, e := range x.entries[signerKey{domain: domain, value: id.Value}] {
+			if id.System == "" || id.System == e.system {
+				result[e.pid] = true
+			}
+		}
+	}
+	return result
+}
+
+// indexPatients resolves the signer ids of the patients in all cached domains.
+// Patients, which can't be resolved in a domain, are skipped.
+func (s *Server) indexPatients(index *signerIndex, pids []string) {
+	domains := s.domainCache.List()
+	for _, pid := range pids {
+		id, err := identity.ParseIdentifier(pid)
+		if err != nil {
+			continue
+		}
+		for _, d := range domains {
+			if signerId, _, err := s.resolveSignerId(id, d); err == nil {
+				index.add(d.Name, signerId, pid)
+			}
+		}
+	}
+}
+
+// reindexSigners rebuilds the index of all subscribed patients, e.g. after the
+// domains changed
+func (s *Server) reindexSigners() {
+	rebuilt := newSignerIndex()
+	s.indexPatients(rebuilt, s.webhooks.Patients())
+	s.signers.replace(rebuilt)
+}
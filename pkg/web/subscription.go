@@ -0,0 +1,159 @@
+package web
+
+import (
+	"consented/pkg/consent"
+	"consented/pkg/identity"
+	"consented/pkg/webhook"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type SubscriptionRequest struct {
+	Url      string   `json:"url" binding:"required,url"`
+	Secret   string   `json:"secret" binding:"required,min=16"`
+	Patients []string `json:"patients" binding:"required,min=1,dive,required"`
+	Domains  []string `json:"domains"`
+}
+
+type SubscriptionResponse struct {
+	Id       string    `json:"id"`
+	Url      string    `json:"url"`
+	Patients []string  `json:"patients"`
+	Domains  []string  `json:"domains"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+// handleSubscribe registers a webhook for status changes of the patients
+func (s *Server) handleSubscribe(c *gin.Context) {
+
+	// bind to struct
+	var r SubscriptionRequest
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.webhooks.ValidateUrl(r.Url); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, pid := range r.Patients {
+		if _, err := identity.ParseIdentifier(pid); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	p := principal(c)
+	for _, name := range r.Domains {
+		d, ok := s.findDomain(name)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("domain not found: '%s'", name)})
+			return
+		}
+		if !s.authz.isAllowed(p, d) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("access to domain denied: '%s'", name)})
+			return
+		}
+	}
+
+	sub := webhook.Subscription{
+		Client:   principalId(c),
+		Url:      r.Url,
+		Secret:   r.Secret,
+		Patients: slices.Compact(slices.Sorted(slices.Values(r.Patients))),
+		Domains:  r.Domains,
+	}
+	if p != nil {
+		sub.Roles = p.Roles
+	}
+	// before subscribing, so that no notification is missed
+	s.indexPatients(s.signers, sub.Patients)
+	sub, err := s.webhooks.Subscribe(sub)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save subscription")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save subscription"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, subscriptionResponse(sub))
+}
+
+// handleListSubscriptions responds with the client's subscriptions
+func (s *Server) handleListSubscriptions(c *gin.Context) {
+	response := make([]SubscriptionResponse, 0)
+	for _, sub := range s.webhooks.Subscriptions(principalId(c)) {
+		response = append(response, subscriptionResponse(sub))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handleUnsubscribe removes the client's subscription
+func (s *Server) handleUnsubscribe(c *gin.Context) {
+	err := s.webhooks.Unsubscribe(principalId(c), c.Param("id"))
+	if errors.Is(err, webhook.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to remove subscription")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove subscription"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// evaluateSubscription returns the current status of the patient in the
+// subscribed domains, which the subscriber was allowed to access with its
+// roles at registration. Revoked roles apply after the subscription expired.
+func (s *Server) evaluateSubscription(sub webhook.Subscription, pid string) ([]consent.DomainStatus, error) {
+	id, err := identity.ParseIdentifier(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]consent.DomainStatus, 0)
+	p := &Principal{Name: strings.TrimPrefix(sub.Client, tokenPrefix), Roles: sub.Roles, Bearer: strings.HasPrefix(sub.Client, tokenPrefix)}
+	allowed, _ := s.filterDomains(nil, p)
+	for _, d := range allowed {
+		if len(sub.Domains) > 0 && !slices.Contains(sub.Domains, d.Name) {
+			continue
+		}
+
+		ds, err := s.createDomainStatus(id, d, nil)
+		// retry all domains with the next check
+		if errors.Is(err, consent.ErrTooManyRequests) {
+			return nil, err
+		}
+		if errors.Is(err, errSignerIdSystem) {
+			continue
+		}
+		if err != nil {
+			result = append(result, failedStatus(d))
+			continue
+		}
+		result = append(result, *ds)
+	}
+	return result, nil
+}
+
+func subscriptionResponse(sub webhook.Subscription) SubscriptionResponse {
+	domains := sub.Domains
+	if domains == nil {
+		domains = make([]string, 0)
+	}
+	return SubscriptionResponse{
+		Id:       sub.Id,
+		Url:      sub.Url,
+		Patients: sub.Patients,
+		Domains:  domains,
+		Created:  sub.Created,
+		Expires:  sub.Expires,
+	}
+}
@@ -0,0 +1,154 @@
+package web
+
+import (
+	"consented/pkg/config"
+	"consented/pkg/consent"
+	"consented/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestHandleSubscriptions(t *testing.T) {
+
+	cases := []HandlerTestCase{
+		{
+			name:           "subscribe",
+			requestUrl:     "/subscriptions",
+			Auth:           testAuth,
+			webhooks:       true,
+			body:           `{"url":"https://dwh.example.org/consent-events","secret":"0123456789abcdef","patients":["43","42","42"],"domains":["Test"]}`,
+			responseStatus: http.StatusCreated,
+			response:       `{"id":"<<PRESENCE>>","url":"https://dwh.example.org/consent-events","patients":["42","43"],"domains":["Test"],"created":"<<PRESENCE>>","expires":"<<PRESENCE>>"}`,
+		},
+		{
+			name:           "subscribeAllDomains",
+			requestUrl:     "/subscriptions",
+			Auth:           testAuth,
+			webhooks:       true,
+			body:           `{"url":"https://dwh.example.org/consent-events","secret":"0123456789abcdef","patients":["42"]}`,
+			responseStatus: http.StatusCreated,
+			response:       `{"id":"<<PRESENCE>>","url":"https://dwh.example.org/consent-events","patients":["42"],"domains":[],"created":"<<PRESENCE>>","expires":"<<PRESENCE>>"}`,
+		},
+		{
+			name:           "subscribeInvalidUrl",
+			requestUrl:     "/subscriptions",
+			Auth:           testAuth,
+			webhooks:       true,
+			body:           `{"url":"dwh","secret":"0123456789abcdef","patients":["42"]}`,
+			responseStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "subscribeUnsupportedScheme",
+			requestUrl:     "/subscriptions",
+			Auth:           testAuth,
+			webhooks:       true,
+			body:           `{"url":"file:///etc/passwd","secret":"0123456789abcdef","patients":["42"]}`,
+			responseStatus: http.StatusBadRequest,
+			response:       `{"error":"webhook url not allowed: scheme 'file'"}`,
+		},
+		{
+			name:           "subscribeShortSecret",
+			requestUrl:     "/subscriptions",
+			Auth:           testAuth,
+			webhooks:       true,
+			body:           `{"url":"https://dwh.example.org/consent-events","secret":"secret","patients":["42"]}`,
+			responseStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "subscribeWithoutPatients",
+			requestUrl:     "/subscriptions",
+			Auth:           testAuth,
+			webhooks:       true,
+			body:           `{"url":"https://dwh.example.org/consent-events","secret":"0123456789abcdef","patients":[]}`,
+			responseStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "subscribeUnknownDomain",
+			requestUrl:     "/subscriptions",
+			Auth:           testAuth,
+			webhooks:       true,
+			body:           `{"url":"https://dwh.example.org/consent-events","secret":"0123456789abcdef","patients":["42"],"domains":["Other"]}`,
+			responseStatus: http.StatusBadRequest,
+			response:       `{"error":"domain not found: 'Other'"}`,
+		},
+		{
+			name:           "subscribeDeniedDomain",
+			requestUrl:     "/subscriptions",
+			Auth:           testAuth,
+			webhooks:       true,
+			authorization:  &config.Authorization{Rules: []config.Rule{{Clients: []string{"test"}, Domains: []string{"Other"}}}},
+			body:           `{"url":"https://dwh.example.org/consent-events","secret":"0123456789abcdef","patients":["42"],"domains":["Test"]}`,
+			responseStatus: http.StatusForbidden,
+			response:       `{"error":"access to domain denied: 'Test'"}`,
+		},
+		{
+			name:           "listSubscriptions",
+			requestUrl:     "/subscriptions",
+			method:         http.MethodGet,
+			Auth:           testAuth,
+			webhooks:       true,
+			responseStatus: http.StatusOK,
+			response:       `[]`,
+		},
+		{
+			name:           "unsubscribeUnknown",
+			requestUrl:     "/subscriptions/1",
+			method:         http.MethodDelete,
+			Auth:           testAuth,
+			webhooks:       true,
+			responseStatus: http.StatusNotFound,
+			response:       `{"error":"subscription not found"}`,
+		},
+		{
+			name:           "webhooksDisabled",
+			requestUrl:     "/subscriptions",
+			Auth:           testAuth,
+			body:           `{"url":"https://dwh.example.org/consent-events","secret":"0123456789abcdef","patients":["42"]}`,
+			responseStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handler(t, c)
+		})
+	}
+}
+
+func TestEvaluateSubscription(t *testing.T) {
+	test := consent.Domain{Name: "Test", CheckPolicyCode: "IDAT_TEST", PersonIdSystem: "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID"}
+	other := consent.Domain{Name: "Other", CheckPolicyCode: "IDAT_TEST", PersonIdSystem: "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID"}
+	denied := consent.Domain{Name: "Denied", CheckPolicyCode: "IDAT_TEST", PersonIdSystem: "https://ths-greifswald.de/fhir/gics/identifiers/Patienten-ID"}
+
+	s := &Server{gicsClient: &TestGicsClient{}, clock: consent.SystemClock{}}
+	s.domainCache = consent.NewDomainCache(nil, -1, consent.Defaults{})
+	s.domainCache.Domains = []consent.Domain{test, other, denied}
+	s.authz, _ = newAuthorizer(config.Authorization{Rules: []config.Rule{{Clients: []string{"registry"}, Domains: []string{"Test", "Other"}}}})
+
+	cases := []struct {
+		name     string
+		sub      webhook.Subscription
+		expected []string
+	}{
+		{"allAllowed", webhook.Subscription{Client: "registry"}, []string{"Test", "Other"}},
+		{"filtered", webhook.Subscription{Client: "registry", Domains: []string{"Other"}}, []string{"Other"}},
+		{"accessRevoked", webhook.Subscription{Client: "registry", Domains: []string{"Denied"}}, []string{}},
+		{"otherClient", webhook.Subscription{Client: "biobank"}, []string{}},
+		{"tokenNamedAfterClient", webhook.Subscription{Client: "token:registry"}, []string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			statuses, err := s.evaluateSubscription(c.sub, "42")
+
+			assert.NoError(t, err)
+			domains := make([]string, 0)
+			for _, ds := range statuses {
+				assert.Equal(t, consent.Accepted, ds.Status)
+				domains = append(domains, ds.Domain)
+			}
+			assert.Equal(t, c.expected, domains)
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package webhook
+
+import (
+	"bytes"
+	"consented/pkg/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventHeader     = "X-Consented-Event"
+	DeliveryHeader  = "X-Consented-Delivery"
+	SignatureHeader = "X-Consented-Signature"
+)
+
+var (
+	deliveredEvents = expvar.NewInt("webhook_events_delivered")
+	failedEvents    = expvar.NewInt("webhook_events_failed")
+)
+
+// ErrUrlNotAllowed is returned for subscription urls of hosts, which are not
+// allowed
+var ErrUrlNotAllowed = errors.New("webhook url not allowed")
+
+// Sender posts events to the subscribers' urls and retries failed deliveries
+// with exponential backoff
+type Sender struct {
+	client       *http.Client
+	maxRetries   int
+	backoff      time.Duration
+	allowedHosts []string
+	requireHttps bool
+	sleep        func(time.Duration)
+	pending      sync.WaitGroup
+}
+
+// statusError is a delivery answered with an unsuccessful status
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("webhook responded with status %d", e.code)
+}
+
+func NewSender(c config.Webhooks) (*Sender, error) {
+	// defaults to ten seconds per attempt
+	timeout, err := parseDuration(c.Timeout, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	// defaults to one second, doubled with each retry
+	backoff, err := parseDuration(c.RetryBackoff, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxRetries < 0 {
+		return nil, fmt.Errorf("invalid 'webhooks.max-retries': %d", c.MaxRetries)
+	}
+
+	return &Sender{
+		client: &http.Client{
+			Timeout: timeout,
+			// redirects could lead to hosts, which are not allowed
+			CheckRedirect: func(_ *http.Request, _ []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		maxRetries:   c.MaxRetries,
+		backoff:      backoff,
+		allowedHosts: c.AllowedHosts,
+		requireHttps: c.RequireHttps,
+		sleep:        time.Sleep,
+	}, nil
+}
+
+// ValidateUrl checks, whether events may be sent to the url
+func (s *Sender) ValidateUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUrlNotAllowed, err)
+	}
+	if u.Scheme != "https" && (s.requireHttps || u.Scheme != "http") {
+		return fmt.Errorf("%w: scheme '%s'", ErrUrlNotAllowed, u.Scheme)
+	}
+	if len(s.allowedHosts) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range s.allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host '%s'", ErrUrlNotAllowed, host)
+}
+
+// Deliver sends the event in the background
+func (s *Sender) Deliver(sub Subscription, e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to serialize webhook event")
+		return
+	}
+
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		s.send(sub, e, body)
+	}()
+}
+
+// Close waits for pending deliveries
+func (s *Sender) Close() {
+	s.pending.Wait()
+}
+
+func (s *Sender) send(sub Subscription, e Event, body []byte) {
+	// the url may not be allowed anymore
+	if err := s.ValidateUrl(sub.Url); err != nil {
+		failedEvents.Add(1)
+		log.Error().Err(err).Str("subscription", sub.Id).Str("event", e.Id).Msg("Failed to deliver webhook event")
+		return
+	}
+
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		err := s.post(sub, e, body)
+		if err == nil {
+			deliveredEvents.Add(1)
+			return
+		}
+		if attempt >= s.maxRetries || !retryable(err) {
+			failedEvents.Add(1)
+			log.Error().Err(err).Str("subscription", sub.Id).Str("event", e.Id).Msg("Failed to deliver webhook event")
+			return
+		}
+
+		log.Warn().Err(err).Str("subscription", sub.Id).Str("event", e.Id).Str("retry-in", backoff.String()).
+			Msg("Failed to deliver webhook event. Retrying.")
+		s.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *Sender) post(sub Subscription, e Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, sub.Url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, e.Type)
+	req.Header.Set(DeliveryHeader, e.Id)
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// retryable is true for network errors, server errors, timeouts and rate
+// limited deliveries. Other responses (e.g. 404) won't succeed on retry.
+func retryable(err error) bool {
+	var se statusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.code >= 500 || se.code == http.StatusRequestTimeout || se.code == http.StatusTooManyRequests
+}
+
+// Sign returns the signature of the body: its HMAC-SHA256 keyed with the
+// subscription's secret (hex encoded, prefixed with 'sha256=')
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
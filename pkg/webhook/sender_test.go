@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"consented/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// echo -n '{"id":"1"}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=6146142a2ce0159e84c0767881e4ec80bc397da62526e7d19f70795eb79460c0", Sign("secret", []byte(`{"id":"1"}`)))
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	cases := []struct {
+		name     string
+		failures int32
+		attempts int32
+		backoff  []time.Duration
+	}{
+		{"delivered", 0, 1, nil},
+		{"retried", 2, 3, []time.Duration{time.Second, 2 * time.Second}},
+		{"givenUp", 10, 4, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if attempts.Add(1) <= c.failures {
+					res.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer s.Close()
+
+			sender, _ := NewSender(config.Webhooks{MaxRetries: 3})
+			var slept []time.Duration
+			sender.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+			sender.Deliver(Subscription{Id: "1", Url: s.URL}, Event{Id: "1", Type: StatusChanged})
+			sender.Close()
+
+			assert.Equal(t, c.attempts, attempts.Load())
+			assert.Equal(t, c.backoff, slept)
+		})
+	}
+}
+
+func TestRetryOnlyTransientFailures(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   int
+		attempts int32
+	}{
+		{"serverError", http.StatusBadGateway, 3},
+		{"timeout", http.StatusRequestTimeout, 3},
+		{"tooManyRequests", http.StatusTooManyRequests, 3},
+		{"notFound", http.StatusNotFound, 1},
+		{"unauthorized", http.StatusUnauthorized, 1},
+		{"redirect", http.StatusFound, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				attempts.Add(1)
+				if c.status == http.StatusFound {
+					res.Header().Set("Location", "http://169.254.169.254/")
+				}
+				res.WriteHeader(c.status)
+			}))
+			defer s.Close()
+
+			sender, _ := NewSender(config.Webhooks{MaxRetries: 2})
+			sender.sleep = func(time.Duration) {}
+
+			sender.Deliver(Subscription{Id: "1", Url: s.URL}, Event{Id: "1", Type: StatusChanged})
+			sender.Close()
+
+			assert.Equal(t, c.attempts, attempts.Load())
+		})
+	}
+}
+
+func TestValidateUrl(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  config.Webhooks
+		url     string
+		allowed bool
+	}{
+		{"http", config.Webhooks{}, "http://dwh.example.org/events", true},
+		{"https", config.Webhooks{}, "https://dwh.example.org/events", true},
+		{"otherScheme", config.Webhooks{}, "ftp://dwh.example.org/events", false},
+		{"httpsRequired", config.Webhooks{RequireHttps: true}, "http://dwh.example.org/events", false},
+		{"allowedHost", config.Webhooks{AllowedHosts: []string{"dwh.example.org"}}, "https://DWH.example.org:8443/events", true},
+		{"otherHost", config.Webhooks{AllowedHosts: []string{"dwh.example.org"}}, "https://169.254.169.254/latest", false},
+		{"allowedSubdomain", config.Webhooks{AllowedHosts: []string{"*.example.org"}}, "https://dwh.example.org/events", true},
+		{"wildcardWithoutSubdomain", config.Webhooks{AllowedHosts: []string{"*.example.org"}}, "https://example.org/events", false},
+		{"wildcardOtherDomain", config.Webhooks{AllowedHosts: []string{"*.example.org"}}, "https://dwh.example.org.evil.com/events", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sender, _ := NewSender(c.config)
+
+			err := sender.ValidateUrl(c.url)
+
+			assert.Equal(t, c.allowed, err == nil)
+			if err != nil {
+				assert.ErrorIs(t, err, ErrUrlNotAllowed)
+			}
+		})
+	}
+}
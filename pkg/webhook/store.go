@@ -0,0 +1,65 @@
+package webhook
+
+import (
+	"cmp"
+	"consented/pkg/consent"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+)
+
+// Store persists the subscriptions (including their secrets) and the last
+// known states of their patients as JSON file
+type Store struct {
+	Path string
+}
+
+// State is the last known status of a subscribed patient in a domain
+type State struct {
+	Subscription string         `json:"subscription"`
+	PatientId    string         `json:"patient-id"`
+	Domain       string         `json:"domain"`
+	Status       consent.Status `json:"status"`
+}
+
+type storeData struct {
+	Subscriptions []Subscription `json:"subscriptions"`
+	States        []State        `json:"states"`
+}
+
+// Load reads the subscriptions and states. A missing file is empty.
+func (s *Store) Load() ([]Subscription, []State, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var d storeData
+	if err = json.Unmarshal(data, &d); err != nil {
+		return nil, nil, err
+	}
+	return d.Subscriptions, d.States, nil
+}
+
+// Save replaces the file with the subscriptions and states
+func (s *Store) Save(subs []Subscription, states []State) error {
+	// stable order of states
+	slices.SortFunc(states, func(a, b State) int {
+		return cmp.Or(cmp.Compare(a.Subscription, b.Subscription), cmp.Compare(a.PatientId, b.PatientId), cmp.Compare(a.Domain, b.Domain))
+	})
+	data, err := json.MarshalIndent(storeData{Subscriptions: subs, States: states}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write atomically, readable by the owner only
+	tmp := s.Path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
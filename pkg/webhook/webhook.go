@@ -0,0 +1,478 @@
+package webhook
+
+import (
+	"consented/pkg/config"
+	"consented/pkg/consent"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// StatusChanged is the type of events sent, if a domain's status changed
+const StatusChanged = "status-changed"
+
+// ErrNotFound is returned for unknown subscriptions
+var ErrNotFound = errors.New("subscription not found")
+
+// Subscription of an API client to status changes of the watched patients
+type Subscription struct {
+	Id string `json:"id"`
+	// Client is the subscriber's id, bearer token subjects are prefixed with
+	// 'token:'
+	Client string `json:"client"`
+	// Roles of the client's bearer token at registration. They apply until
+	// the subscription expires or is removed.
+	Roles  []string `json:"roles,omitempty"`
+	Url    string   `json:"url"`
+	Secret string   `json:"secret"`
+	// Patients watched (raw patient ids as requested)
+	Patients []string `json:"patients"`
+	// Domains watched (empty: all domains the client may access)
+	Domains []string  `json:"domains,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Event notifies the subscriber about a changed domain status
+type Event struct {
+	Id           string         `json:"id"`
+	Type         string         `json:"type"`
+	Subscription string         `json:"subscription"`
+	PatientId    string         `json:"patient-id"`
+	Domain       string         `json:"domain"`
+	OldStatus    consent.Status `json:"old-status"`
+	NewStatus    consent.Status `json:"new-status"`
+	Timestamp    time.Time      `json:"timestamp"`
+}
+
+// Evaluator returns the current status of the patient in the domains the
+// subscription watches
+type Evaluator func(s Subscription, pid string) ([]consent.DomainStatus, error)
+
+// Auditor records the statuses of the patient sent to the subscriber
+type Auditor func(s Subscription, pid string, delivered []consent.DomainStatus)
+
+// Manager keeps the subscriptions and the last known status per subscription,
+// patient and domain. Changes are sent to the subscribers. With a store, both
+// survive restarts, i.e. changes while down are sent with the first check.
+type Manager struct {
+	evaluate Evaluator
+	audit    Auditor
+	sender   *Sender
+	store    *Store
+	interval time.Duration
+	ttl      time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	subs     []Subscription
+	states   map[stateKey]consent.Status
+	// locks serialize the checks per subscription and patient
+	locks map[patientKey]*patientLock
+	// quit stops the periodic checks
+	quit chan bool
+	// pending initial evaluations and periodic checks
+	pending sync.WaitGroup
+}
+
+type stateKey struct {
+	subscription string
+	pid          string
+	domain       string
+}
+
+type patientKey struct {
+	subscription string
+	pid          string
+}
+
+// patientLock is held while evaluating a patient and updating its states,
+// refs counts the waiting checks
+type patientLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewManager creates the webhook manager. It returns nil if webhooks are
+// disabled. Deliveries are audited, if an auditor is given.
+func NewManager(c config.Webhooks, evaluate Evaluator, audit Auditor) (*Manager, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	// defaults to one hour
+	interval, err := parseDuration(c.CheckInterval, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	// defaults to 30 days
+	ttl, err := parseDuration(c.SubscriptionTtl, 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := NewSender(c)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		evaluate: evaluate,
+		audit:    audit,
+		sender:   sender,
+		interval: interval,
+		ttl:      ttl,
+		now:      time.Now,
+		states:   make(map[stateKey]consent.Status),
+		locks:    make(map[patientKey]*patientLock),
+	}
+	if c.Store != "" {
+		m.store = &Store{Path: c.Store}
+		var states []State
+		if m.subs, states, err = m.store.Load(); err != nil {
+			return nil, err
+		}
+		for _, st := range states {
+			m.states[stateKey{subscription: st.Subscription, pid: st.PatientId, domain: st.Domain}] = st.Status
+		}
+		// stored without expiry
+		for i, s := range m.subs {
+			if s.Expires.IsZero() {
+				m.subs[i].Expires = s.Created.Add(ttl)
+			}
+		}
+	}
+	return m, nil
+}
+
+// Start evaluates all subscriptions and re-evaluates them periodically
+func (m *Manager) Start() chan bool {
+	quit := make(chan bool)
+	if m == nil {
+		return quit
+	}
+
+	log.Info().Int("subscriptions", len(m.subs)).Str("check-interval", m.interval.String()).
+		Msg("Watching subscribed patients. Checking periodically.")
+
+	m.quit = quit
+	ticker := time.NewTicker(m.interval)
+	m.pending.Add(1)
+	go func() {
+		defer m.pending.Done()
+		m.CheckAll()
+		for {
+			select {
+			case <-ticker.C:
+				m.CheckAll()
+			case <-quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return quit
+}
+
+// Subscribe registers the subscription and evaluates the initial status of
+// its patients in the background. It expires after the configured lifetime.
+func (m *Manager) Subscribe(s Subscription) (Subscription, error) {
+	s.Id = newId()
+	s.Created = m.now()
+	s.Expires = s.Created.Add(m.ttl)
+
+	m.mu.Lock()
+	subs := append(slices.Clone(m.subs), s)
+	err := m.save(subs)
+	if err == nil {
+		m.subs = subs
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return s, err
+	}
+
+	m.pending.Add(1)
+	go func() {
+		defer m.pending.Done()
+		m.check(s, s.Patients)
+	}()
+	return s, nil
+}
+
+// ValidateUrl checks, whether events may be sent to the subscription url
+func (m *Manager) ValidateUrl(url string) error {
+	return m.sender.ValidateUrl(url)
+}
+
+// Unsubscribe removes the client's subscription
+func (m *Manager) Unsubscribe(client string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.IndexFunc(m.subs, func(s Subscription) bool { return s.Id == id && s.Client == client })
+	if i < 0 {
+		return ErrNotFound
+	}
+	subs := slices.Delete(slices.Clone(m.subs), i, i+1)
+	if err := m.save(subs); err != nil {
+		return err
+	}
+	m.subs = subs
+	m.deleteStates(id)
+	return nil
+}
+
+// Subscriptions returns the client's subscriptions
+func (m *Manager) Subscriptions(client string) []Subscription {
+	result := make([]Subscription, 0)
+	for _, s := range m.snapshot() {
+		if s.Client == client {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// Patients returns the patients watched by any subscription
+func (m *Manager) Patients() []string {
+	if m == nil {
+		return nil
+	}
+	var pids []string
+	for _, s := range m.snapshot() {
+		pids = append(pids, s.Patients...)
+	}
+	slices.Sort(pids)
+	return slices.Compact(pids)
+}
+
+// CheckAll removes expired subscriptions and re-evaluates the patients of
+// all others
+func (m *Manager) CheckAll() {
+	if m == nil {
+		return
+	}
+	m.removeExpired()
+	for _, s := range m.snapshot() {
+		m.check(s, s.Patients)
+	}
+}
+
+// CheckPatients re-evaluates the subscribed patients, which match, e.g.
+// after gICS notified about a changed consent
+func (m *Manager) CheckPatients(match func(s Subscription, pid string) bool) {
+	if m == nil {
+		return
+	}
+	for _, s := range m.snapshot() {
+		var patients []string
+		for _, pid := range s.Patients {
+			if match(s, pid) {
+				patients = append(patients, pid)
+			}
+		}
+		m.check(s, patients)
+	}
+}
+
+// Close stops the periodic checks and waits for running evaluations and
+// pending deliveries
+func (m *Manager) Close() {
+	if m == nil {
+		return
+	}
+	if m.quit != nil {
+		close(m.quit)
+	}
+	m.pending.Wait()
+	m.sender.Close()
+}
+
+// snapshot returns the subscriptions, which are not expired
+func (m *Manager) snapshot() []Subscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	return slices.DeleteFunc(slices.Clone(m.subs), func(s Subscription) bool { return !now.Before(s.Expires) })
+}
+
+// removeExpired removes the expired subscriptions and their states
+func (m *Manager) removeExpired() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	var expired []string
+	subs := slices.DeleteFunc(slices.Clone(m.subs), func(s Subscription) bool {
+		if now.Before(s.Expires) {
+			return false
+		}
+		expired = append(expired, s.Id)
+		return true
+	})
+	if len(expired) == 0 {
+		return
+	}
+	if err := m.save(subs); err != nil {
+		log.Error().Err(err).Msg("Failed to remove expired subscriptions")
+		return
+	}
+	m.subs = subs
+	for _, id := range expired {
+		log.Info().Str("subscription", id).Msg("Removed expired subscription")
+		m.deleteStates(id)
+	}
+}
+
+// deleteStates removes the states of the subscription. The caller must hold
+// the lock.
+func (m *Manager) deleteStates(id string) {
+	for k := range m.states {
+		if k.subscription == id {
+			delete(m.states, k)
+		}
+	}
+}
+
+// check evaluates the patients and sends an event for each changed status.
+// The first evaluation only records the status.
+func (m *Manager) check(s Subscription, patients []string) {
+	for _, pid := range patients {
+		m.checkPatient(s, pid)
+	}
+}
+
+// checkPatient evaluates the patient and updates its states. Concurrent checks
+// of the same patient (e.g. periodic and notified ones) are serialized, so
+// that a stale evaluation doesn't overwrite a newer one.
+func (m *Manager) checkPatient(s Subscription, pid string) {
+	unlock := m.lock(patientKey{subscription: s.Id, pid: pid})
+	defer unlock()
+
+	statuses, err := m.evaluate(s, pid)
+	if err != nil {
+		log.Warn().Err(err).Str("subscription", s.Id).Msg("Failed to evaluate subscribed patient. Retrying with next check.")
+		return
+	}
+
+	var events []Event
+	var delivered []consent.DomainStatus
+	recorded := false
+	for _, ds := range statuses {
+		// keep the last known status, if the evaluation failed
+		if ds.Status == consent.Failed {
+			continue
+		}
+		e, changed, ok := m.update(s, pid, ds)
+		recorded = recorded || ok
+		if changed {
+			events = append(events, e)
+			delivered = append(delivered, ds)
+		}
+	}
+
+	// saved once per patient, before delivering the events
+	if recorded {
+		m.mu.Lock()
+		if err := m.save(m.subs); err != nil {
+			log.Error().Err(err).Str("subscription", s.Id).Msg("Failed to save subscribed patient's status")
+		}
+		m.mu.Unlock()
+	}
+	for _, e := range events {
+		m.sender.Deliver(s, e)
+	}
+	if len(delivered) > 0 && m.audit != nil {
+		m.audit(s, pid, delivered)
+	}
+}
+
+// lock acquires the patient's lock and returns the function releasing it
+func (m *Manager) lock(k patientKey) func() {
+	m.mu.Lock()
+	l, ok := m.locks[k]
+	if !ok {
+		l = &patientLock{}
+		m.locks[k] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, k)
+		}
+	}
+}
+
+// update records the domain status and returns the event, if it changed.
+// Recorded is true for new or changed states, which need to be saved.
+func (m *Manager) update(s Subscription, pid string, ds consent.DomainStatus) (e Event, changed bool, recorded bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// subscription removed meanwhile
+	if !slices.ContainsFunc(m.subs, func(sub Subscription) bool { return sub.Id == s.Id }) {
+		return Event{}, false, false
+	}
+
+	key := stateKey{subscription: s.Id, pid: pid, domain: ds.Domain}
+	old, known := m.states[key]
+	if known && old == ds.Status {
+		return Event{}, false, false
+	}
+	m.states[key] = ds.Status
+	if !known {
+		return Event{}, false, true
+	}
+
+	return Event{
+		Id:           newId(),
+		Type:         StatusChanged,
+		Subscription: s.Id,
+		PatientId:    pid,
+		Domain:       ds.Domain,
+		OldStatus:    old,
+		NewStatus:    ds.Status,
+		Timestamp:    m.now(),
+	}, true, true
+}
+
+// save persists the subscriptions and the states of their patients, if a
+// store is configured. The caller must hold the lock.
+func (m *Manager) save(subs []Subscription) error {
+	if m.store == nil {
+		return nil
+	}
+
+	states := make([]State, 0, len(m.states))
+	for k, status := range m.states {
+		if slices.ContainsFunc(subs, func(s Subscription) bool { return s.Id == k.subscription }) {
+			states = append(states, State{Subscription: k.subscription, PatientId: k.pid, Domain: k.domain, Status: status})
+		}
+	}
+	return m.store.Save(subs, states)
+}
+
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// newId returns a random hex encoded id
+func newId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
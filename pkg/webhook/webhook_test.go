@@ -0,0 +1,270 @@
+package webhook
+
+import (
+	"consented/pkg/config"
+	"consented/pkg/consent"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// statuses is a mutable evaluator returning the status per patient
+type statuses struct {
+	mu     sync.Mutex
+	status map[string]consent.Status
+}
+
+func (s *statuses) set(pid string, status consent.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status[pid] = status
+}
+
+func (s *statuses) evaluate(_ Subscription, pid string) ([]consent.DomainStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []consent.DomainStatus{{Domain: "MII", Status: s.status[pid]}}, nil
+}
+
+func receiver(t *testing.T) (*httptest.Server, chan Event) {
+	events := make(chan Event, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		assert.Equal(t, Sign("0123456789abcdef", b), req.Header.Get(SignatureHeader))
+		assert.Equal(t, StatusChanged, req.Header.Get(EventHeader))
+
+		var e Event
+		assert.NoError(t, json.Unmarshal(b, &e))
+		events <- e
+	}))
+	return s, events
+}
+
+func patient(pid string) func(Subscription, string) bool {
+	return func(_ Subscription, p string) bool { return p == pid }
+}
+
+func TestNewManagerDisabled(t *testing.T) {
+	m, err := NewManager(config.Webhooks{}, nil, nil)
+
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	// nil manager ignores checks
+	m.CheckPatients(func(_ Subscription, _ string) bool { return true })
+	m.CheckAll()
+	m.Close()
+}
+
+func TestNewManagerInvalidConfig(t *testing.T) {
+	cases := []config.Webhooks{
+		{Enabled: true, CheckInterval: "hourly"},
+		{Enabled: true, Timeout: "10"},
+		{Enabled: true, RetryBackoff: "1"},
+		{Enabled: true, MaxRetries: -1},
+		{Enabled: true, SubscriptionTtl: "30d"},
+	}
+
+	for _, c := range cases {
+		_, err := NewManager(c, nil, nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestStartAndClose(t *testing.T) {
+	var calls atomic.Int32
+	evaluate := func(_ Subscription, _ string) ([]consent.DomainStatus, error) {
+		calls.Add(1)
+		return nil, nil
+	}
+	m, _ := NewManager(config.Webhooks{Enabled: true}, evaluate, nil)
+	m.subs = []Subscription{{Id: "1", Patients: []string{"42"}, Expires: time.Now().Add(time.Hour)}}
+
+	m.Start()
+	// waits for the initial check
+	m.Close()
+
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestStatusChanged(t *testing.T) {
+	s, events := receiver(t)
+	defer s.Close()
+
+	st := &statuses{status: map[string]consent.Status{"42": consent.Accepted, "43": consent.Accepted}}
+	var audited []string
+	audit := func(s Subscription, pid string, delivered []consent.DomainStatus) {
+		assert.Equal(t, "registry", s.Client)
+		assert.Len(t, delivered, 1)
+		audited = append(audited, pid)
+	}
+	m, _ := NewManager(config.Webhooks{Enabled: true}, st.evaluate, audit)
+	sub, _ := m.Subscribe(Subscription{Client: "registry", Url: s.URL, Secret: "0123456789abcdef", Patients: []string{"42", "43"}})
+	// initial status is recorded without events
+	m.pending.Wait()
+
+	st.set("42", consent.Withdrawn)
+	m.CheckAll()
+	// unchanged
+	m.CheckAll()
+	m.Close()
+
+	assert.Len(t, events, 1)
+	e := <-events
+	assert.Equal(t, sub.Id, e.Subscription)
+	assert.Equal(t, "42", e.PatientId)
+	assert.Equal(t, "MII", e.Domain)
+	assert.Equal(t, consent.Accepted, e.OldStatus)
+	assert.Equal(t, consent.Withdrawn, e.NewStatus)
+	assert.Equal(t, []string{"42"}, audited)
+}
+
+func TestCheckPatients(t *testing.T) {
+	s, events := receiver(t)
+	defer s.Close()
+
+	st := &statuses{status: map[string]consent.Status{"42": consent.Accepted}}
+	m, _ := NewManager(config.Webhooks{Enabled: true}, st.evaluate, nil)
+	_, _ = m.Subscribe(Subscription{Client: "registry", Url: s.URL, Secret: "0123456789abcdef", Patients: []string{"42"}})
+	m.pending.Wait()
+
+	// failed evaluations keep the last known status
+	st.set("42", consent.Failed)
+	m.CheckPatients(patient("42"))
+	st.set("42", consent.Accepted)
+	m.CheckPatients(patient("42"))
+	assert.Len(t, events, 0)
+
+	// other patients are not watched
+	st.set("43", consent.Declined)
+	m.CheckPatients(patient("43"))
+	st.set("42", consent.Expired)
+	m.CheckPatients(patient("42"))
+	m.Close()
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, consent.Expired, (<-events).NewStatus)
+}
+
+func TestCheckSerializedPerPatient(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan bool)
+	evaluate := func(_ Subscription, _ string) ([]consent.DomainStatus, error) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		return []consent.DomainStatus{{Domain: "MII", Status: consent.Accepted}}, nil
+	}
+	m, _ := NewManager(config.Webhooks{Enabled: true}, evaluate, nil)
+	sub := Subscription{Id: "1", Patients: []string{"42"}, Expires: time.Now().Add(time.Hour)}
+	m.subs = []Subscription{sub}
+
+	first := make(chan bool)
+	go func() {
+		m.check(sub, sub.Patients)
+		close(first)
+	}()
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+
+	// waits for the first check
+	second := make(chan bool)
+	go func() {
+		m.CheckAll()
+		close(second)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), calls.Load())
+
+	close(release)
+	<-first
+	<-second
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Len(t, m.locks, 0)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	st := &statuses{status: map[string]consent.Status{}}
+	m, _ := NewManager(config.Webhooks{Enabled: true}, st.evaluate, nil)
+	sub, _ := m.Subscribe(Subscription{Client: "registry", Url: "http://localhost", Patients: []string{"42"}})
+	m.pending.Wait()
+
+	assert.Len(t, m.Subscriptions("registry"), 1)
+	assert.Len(t, m.Subscriptions("biobank"), 0)
+
+	// subscriptions of other clients
+	assert.ErrorIs(t, m.Unsubscribe("biobank", sub.Id), ErrNotFound)
+	assert.NoError(t, m.Unsubscribe("registry", sub.Id))
+	assert.ErrorIs(t, m.Unsubscribe("registry", sub.Id), ErrNotFound)
+	assert.Len(t, m.Subscriptions("registry"), 0)
+	assert.Len(t, m.states, 0)
+}
+
+func TestSubscriptionExpires(t *testing.T) {
+	c := config.Webhooks{Enabled: true, SubscriptionTtl: "1h", Store: path.Join(t.TempDir(), "subscriptions.json")}
+	st := &statuses{status: map[string]consent.Status{"42": consent.Accepted}}
+	m, _ := NewManager(c, st.evaluate, nil)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	sub, _ := m.Subscribe(Subscription{Client: "registry", Url: "http://localhost", Patients: []string{"42"}})
+	m.pending.Wait()
+	assert.Equal(t, now.Add(time.Hour), sub.Expires)
+
+	now = now.Add(time.Hour)
+	assert.Len(t, m.Subscriptions("registry"), 0)
+	m.CheckAll()
+	assert.Len(t, m.subs, 0)
+	assert.Len(t, m.states, 0)
+
+	// removed from the store
+	m, _ = NewManager(c, st.evaluate, nil)
+	assert.Len(t, m.subs, 0)
+}
+
+func TestPersistSubscriptions(t *testing.T) {
+	c := config.Webhooks{Enabled: true, Store: path.Join(t.TempDir(), "subscriptions.json")}
+	st := &statuses{status: map[string]consent.Status{}}
+
+	m, _ := NewManager(c, st.evaluate, nil)
+	sub, _ := m.Subscribe(Subscription{Client: "registry", Url: "http://localhost", Secret: "0123456789abcdef", Patients: []string{"42"}})
+	m.Close()
+
+	m, err := NewManager(c, st.evaluate, nil)
+	assert.NoError(t, err)
+	subs := m.Subscriptions("registry")
+	assert.Len(t, subs, 1)
+	assert.Equal(t, sub.Id, subs[0].Id)
+	assert.Equal(t, "0123456789abcdef", subs[0].Secret)
+
+	assert.NoError(t, m.Unsubscribe("registry", sub.Id))
+	m, _ = NewManager(c, st.evaluate, nil)
+	assert.Len(t, m.Subscriptions("registry"), 0)
+}
+
+func TestPersistStates(t *testing.T) {
+	s, events := receiver(t)
+	defer s.Close()
+
+	c := config.Webhooks{Enabled: true, Store: path.Join(t.TempDir(), "subscriptions.json")}
+	st := &statuses{status: map[string]consent.Status{"42": consent.Accepted}}
+	m, _ := NewManager(c, st.evaluate, nil)
+	_, _ = m.Subscribe(Subscription{Client: "registry", Url: s.URL, Secret: "0123456789abcdef", Patients: []string{"42"}})
+	m.Close()
+
+	// changed while down
+	st.set("42", consent.Withdrawn)
+	m, _ = NewManager(c, st.evaluate, nil)
+	m.CheckAll()
+	m.Close()
+
+	assert.Len(t, events, 1)
+	e := <-events
+	assert.Equal(t, consent.Accepted, e.OldStatus)
+	assert.Equal(t, consent.Withdrawn, e.NewStatus)
+}